@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// validate checks the parts of the config that can be checked without
+// reference to the host, so that mistakes are reported when the config is
+// loaded, whichever command is being run.
+func (c Config) validate() error {
+	if err := validateEnvironmentPatterns(c.PassEnvironment); err != nil {
+		return err
+	}
+	if _, err := killGracePeriod(c, Wrapper{}); err != nil {
+		return err
+	}
+	if c.SlirpBackend != "" {
+		found := false
+		for _, backend := range slirpBackends {
+			found = found || (backend == c.SlirpBackend)
+		}
+		if !found {
+			return fmt.Errorf("unknown slirp_backend %q", c.SlirpBackend)
+		}
+	}
+
+	for name := range c.Volumes {
+		if err := validateVolumeName(name); err != nil {
+			return err
+		}
+	}
+
+	for name, command := range c.Commands {
+		if err := command.validate(c); err != nil {
+			return fmt.Errorf("command %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (w Wrapper) validate(conf Config) error {
+	if err := validateEnvironmentPatterns(w.PassEnvironment); err != nil {
+		return err
+	}
+	if _, err := killGracePeriod(conf, w); err != nil {
+		return err
+	}
+	if w.Timeout != "" {
+		if _, err := parseDurationSetting("timeout", w.Timeout); err != nil {
+			return err
+		}
+	}
+	if w.TrackFiles && conf.Provenance == nil {
+		return fmt.Errorf("track_files needs provenance to be enabled")
+	}
+	if err := validateNetworking(w.Networking, w.Ports); err != nil {
+		return err
+	}
+	if err := validateSeccomp(w.Seccomp); err != nil {
+		return err
+	}
+	if err := validateUserMode(w.User); err != nil {
+		return err
+	}
+	if err := validateHomeMode(w.Home); err != nil {
+		return err
+	}
+	if err := validateVolumes(conf, w.Volumes); err != nil {
+		return err
+	}
+	if _, _, err := w.tmpfsSettings(); err != nil {
+		return err
+	}
+	if _, err := resolveCapabilities(w.CapAdd, w.CapDrop); err != nil {
+		return err
+	}
+	if err := validateContainerPaths("masked_paths", w.MaskedPaths); err != nil {
+		return err
+	}
+	if err := validateContainerPaths("readonly_paths", w.ReadonlyPaths); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseDurationSetting(name string, value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %q: %w", name, value, err)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %v", name, duration)
+	}
+	return duration, nil
+}
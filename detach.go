@@ -0,0 +1,767 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Commands run with --fsark-detach, or with FSARK_DETACH set, run in the
+// background. fsark starts a copy of itself in a new session to supervise the
+// container, with the output of both going to log files in the state
+// directory, and once the container has started prints the name it was given
+// and exits. The supervisor stays around to forward signals, enforce the
+// timeout, clean up and record the exit code, just as fsark does for a
+// foreground run, and the ps, logs, stop, wait and rm subcommands find
+// containers by their name.
+
+const (
+	containersDirectoryName = "containers"
+	containerRecordFilename = "container.json"
+	supervisorLockFilename  = "supervisor.lock"
+	bundlesDirectoryName    = "bundles"
+	stdoutLogFilename       = "stdout.log"
+	stderrLogFilename       = "stderr.log"
+
+	// containerNameVariable tells the supervisor which container it is
+	containerNameVariable = "FSARK_CONTAINER_NAME"
+	// the supervisor writes to the first of its ExtraFiles once the runtime
+	// has started the container, so that we know it got that far
+	supervisorReadyFD = 3
+	// and holds the lock that is the second for as long as it runs
+	supervisorLockFD = 4
+
+	containerPollInterval = 200 * time.Millisecond
+
+	// the started hook is run by the runtime once it has started the
+	// container, and leaves a file in the bundle to say so
+	startedHookName       = "started"
+	startedMarkerFilename = "started"
+)
+
+type detachedContainer struct {
+	Name     string     `json:"name"`
+	Command  string     `json:"command"`
+	Args     []string   `json:"args"`
+	Cwd      string     `json:"cwd"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+
+	// These are filled in by the supervisor, the runtime once the
+	// container is started
+	PID     int            `json:"pid,omitempty"`
+	Bundle  string         `json:"bundle,omitempty"`
+	Runtime *runtimeRecord `json:"runtime,omitempty"`
+
+	// dir is where the record was read from
+	dir string
+}
+
+func newContainerName(command string) (string, error) {
+	buffer := make([]byte, 3)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate container name: %w", err)
+	}
+	return fmt.Sprintf("%s-%s", command, hex.EncodeToString(buffer)), nil
+}
+
+// createContainerDirectory makes the state directory for a new detached
+// container, picking a name that isn't already taken.
+func createContainerDirectory(containersDir string, command string) (string, string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		name, err := newContainerName(command)
+		if err != nil {
+			return "", "", err
+		}
+		dir := filepath.Join(containersDir, name)
+		err = os.Mkdir(dir, 0700)
+		if err == nil {
+			return name, dir, nil
+		}
+		if !os.IsExist(err) {
+			return "", "", fmt.Errorf("failed to create container directory: %w", err)
+		}
+	}
+	return "", "", fmt.Errorf("failed to find an unused container name")
+}
+
+// write replaces the record in the container's directory, via a rename so
+// that anyone reading it never sees it half written.
+func (c detachedContainer) write(dir string) error {
+	content, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode container record: %w", err)
+	}
+	temporary := filepath.Join(dir, containerRecordFilename+".tmp")
+	err = os.WriteFile(temporary, content, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write container record: %w", err)
+	}
+	err = os.Rename(temporary, filepath.Join(dir, containerRecordFilename))
+	if err != nil {
+		return fmt.Errorf("failed to write container record: %w", err)
+	}
+	return nil
+}
+
+func readDetachedContainer(dir string) (detachedContainer, error) {
+	content, err := os.ReadFile(filepath.Join(dir, containerRecordFilename))
+	if err != nil {
+		return detachedContainer{}, fmt.Errorf("failed to read container record: %w", err)
+	}
+	var container detachedContainer
+	err = json.Unmarshal(content, &container)
+	if err != nil {
+		return detachedContainer{}, fmt.Errorf("failed to parse container record %v: %w", dir, err)
+	}
+	container.dir = dir
+	return container, nil
+}
+
+// listDetachedContainers returns the containers in the state directory, oldest
+// first. Directories without a record are skipped, as they're either being
+// created or being removed.
+func listDetachedContainers(containersDir string) ([]detachedContainer, error) {
+	entries, err := os.ReadDir(containersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read containers: %w", err)
+	}
+	var containers []detachedContainer
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		container, err := readDetachedContainer(filepath.Join(containersDir, entry.Name()))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.Before(containers[j].Created)
+	})
+	return containers, nil
+}
+
+var errNoContainer = errors.New("no container")
+
+// findDetachedContainer looks a container up by its name, or by a prefix of
+// its name that matches no other container.
+func findDetachedContainer(containersDir string, name string) (detachedContainer, error) {
+	containers, err := listDetachedContainers(containersDir)
+	if err != nil {
+		return detachedContainer{}, err
+	}
+	var matches []detachedContainer
+	for _, container := range containers {
+		if container.Name == name {
+			return container, nil
+		}
+		if strings.HasPrefix(container.Name, name) {
+			matches = append(matches, container)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return detachedContainer{}, fmt.Errorf("%w named %v", errNoContainer, name)
+	case 1:
+		return matches[0], nil
+	default:
+		return detachedContainer{}, fmt.Errorf("%v matches more than one container", name)
+	}
+}
+
+// lockSupervisor takes the lock that says the container's supervisor is
+// alive, which startDetached does before starting the supervisor and hands
+// on to it, so that there's no gap before the supervisor is running.
+func lockSupervisor(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, supervisorLockFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create supervisor lock: %w", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock supervisor lock: %w", err)
+	}
+	return file, nil
+}
+
+// supervisorAlive is true whilst the supervisor's lock is held. Unlike
+// checking its PID, this can't be fooled by the PID being reused.
+func supervisorAlive(dir string) bool {
+	file, err := os.Open(filepath.Join(dir, supervisorLockFilename))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+// running is true until the supervisor has exited.
+func (c detachedContainer) running() bool {
+	return c.ExitCode == nil && supervisorAlive(c.dir)
+}
+
+func (c detachedContainer) status() string {
+	switch {
+	case c.ExitCode != nil:
+		return fmt.Sprintf("exited (%d)", *c.ExitCode)
+	case !supervisorAlive(c.dir):
+		// the supervisor was killed before it could record the exit code
+		return "dead"
+	case c.Started == nil:
+		return "starting"
+	default:
+		return "running"
+	}
+}
+
+// pollContainer rereads the container's record until done is true of it.
+func pollContainer(containersDir string, container detachedContainer, done func(detachedContainer) bool) (detachedContainer, error) {
+	dir := filepath.Join(containersDir, container.Name)
+	for !done(container) {
+		time.Sleep(containerPollInterval)
+		var err error
+		container, err = readDetachedContainer(dir)
+		if err != nil {
+			return detachedContainer{}, err
+		}
+	}
+	return container, nil
+}
+
+// waitForExit polls the container's record until its supervisor has exited,
+// and returns the final record.
+func waitForExit(containersDir string, container detachedContainer) (detachedContainer, error) {
+	return pollContainer(containersDir, container, func(c detachedContainer) bool {
+		return !c.running()
+	})
+}
+
+// startDetached runs the invocation in the background under a supervising
+// copy of fsark, returning once the runtime has started the container. If
+// the supervisor or the runtime fails before then, the supervisor exits
+// without saying it's ready, and its errors are passed on and the
+// container's state removed.
+func startDetached(inv invocation) int {
+	containersDir, err := stateSubdirectory(inv.conf, inv.variables, containersDirectoryName)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	name, dir, err := createContainerDirectory(containersDir, inv.name)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	started := false
+	defer func() {
+		if !started {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// the lock is taken before there's a record, so that the container is
+	// never seen without it
+	lock, err := lockSupervisor(dir)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	defer lock.Close()
+
+	record := detachedContainer{
+		Name:    name,
+		Command: inv.name,
+		Args:    inv.args,
+		Cwd:     inv.cwd,
+		Created: time.Now(),
+	}
+	err = record.write(dir)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	stdout, err := os.Create(filepath.Join(dir, stdoutLogFilename))
+	if err != nil {
+		logError("Failed to create log file: %v", err)
+		return 1
+	}
+	defer stdout.Close()
+	stderrPath := filepath.Join(dir, stderrLogFilename)
+	stderr, err := os.Create(stderrPath)
+	if err != nil {
+		logError("Failed to create log file: %v", err)
+		return 1
+	}
+	defer stderr.Close()
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		logError("Failed to open %v: %v", os.DevNull, err)
+		return 1
+	}
+	defer stdin.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		logError("Failed to create pipe: %v", err)
+		return 1
+	}
+	defer readyReader.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		logError("Failed to find fsark executable: %v", err)
+		return 1
+	}
+	// The supervisor is run with the same arguments, so it goes through
+	// exactly what we did to get here, be that a command or a subcommand.
+	cmd := &exec.Cmd{
+		Path:        self,
+		Args:        os.Args,
+		Env:         append(os.Environ(), fmt.Sprintf("%s=%s", containerNameVariable, name)),
+		Stdin:       stdin,
+		Stdout:      stdout,
+		Stderr:      stderr,
+		ExtraFiles:  []*os.File{readyWriter, lock},
+		SysProcAttr: &syscall.SysProcAttr{Setsid: true},
+	}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		logError("Failed to start fsark in the background: %v", err)
+		return 1
+	}
+
+	ready := make(chan bool, 1)
+	go func() {
+		buffer := make([]byte, 1)
+		count, _ := readyReader.Read(buffer)
+		ready <- count == 1
+	}()
+	for {
+		select {
+		case sig := <-inv.signals:
+			// the supervisor is in its own session, so pass on anything
+			// meant for us whilst it's preparing the container
+			cmd.Process.Signal(sig)
+			continue
+		case ok := <-ready:
+			if ok {
+				started = true
+				cmd.Process.Release()
+				fmt.Println(name)
+				return 0
+			}
+		}
+		break
+	}
+
+	retcode, err := exitCodeFromError(cmd.Wait())
+	if err != nil {
+		logError("%v", err)
+	}
+	if output, err := os.ReadFile(stderrPath); err == nil {
+		os.Stderr.Write(output)
+	}
+	if retcode == 0 {
+		retcode = 1
+	}
+	return retcode
+}
+
+// containerSupervisor is the state of the copy of fsark running a detached
+// container.
+type containerSupervisor struct {
+	dir    string
+	record detachedContainer
+}
+
+// resumeSupervisor is called by the supervisor to take over the record
+// made for it by startDetached.
+func resumeSupervisor(conf Config, variables expansionVariables, name string) (*containerSupervisor, error) {
+	containersDir, err := stateSubdirectory(conf, variables, containersDirectoryName)
+	if err != nil {
+		return nil, err
+	}
+	// The bundle is kept apart from the logs, as it goes when the
+	// container exits, and it's named after the container as the secrets
+	// directory is named after it
+	bundlesDir, err := stateSubdirectory(conf, variables, bundlesDirectoryName)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(containersDir, name)
+	record, err := readDetachedContainer(dir)
+	if err != nil {
+		return nil, err
+	}
+	// we hold on to the lock until we exit, but nothing we run should, and
+	// nor should it hold the ready pipe open if we fail
+	syscall.CloseOnExec(supervisorLockFD)
+	syscall.CloseOnExec(supervisorReadyFD)
+	record.PID = os.Getpid()
+	record.Bundle = filepath.Join(bundlesDir, name)
+	err = record.write(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &containerSupervisor{dir: dir, record: record}, nil
+}
+
+// started records that the runtime has started the container and lets
+// startDetached know, so it can return.
+func (s *containerSupervisor) started(runtime ociRuntime) error {
+	now := time.Now()
+	s.record.Started = &now
+	record := newRuntimeRecord(runtime)
+	s.record.Runtime = &record
+	err := s.record.write(s.dir)
+	if err != nil {
+		return err
+	}
+	ready := os.NewFile(supervisorReadyFD, "ready")
+	defer ready.Close()
+	_, err = ready.Write([]byte{1})
+	if err != nil {
+		return fmt.Errorf("failed to report container started: %w", err)
+	}
+	return nil
+}
+
+// addStartedHook has the runtime run fsark as a hook once it has started the
+// container, so that the supervisor only reports the container as started
+// once the runtime has got that far.
+func addStartedHook(spec *specs.Spec) error {
+	fsarkPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find fsark executable for started hook: %w", err)
+	}
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+	spec.Hooks.Poststart = append(spec.Hooks.Poststart, specs.Hook{
+		Path: fsarkPath,
+		Args: []string{fsarkPath},
+		Env:  []string{fmt.Sprintf("%s=%s", hookEnvironmentVariable, startedHookName)},
+	})
+	return nil
+}
+
+// runStartedHook is run by the runtime once the container has started, with
+// the container state on stdin, and marks the bundle as started.
+func runStartedHook() error {
+	var state containerState
+	err := json.NewDecoder(os.Stdin).Decode(&state)
+	if err != nil {
+		return fmt.Errorf("failed to read container state: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(state.Bundle, startedMarkerFilename), nil, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to mark container as started: %w", err)
+	}
+	return nil
+}
+
+// containerStarted is true once the started hook has run for the bundle.
+func containerStarted(bundlePath string) bool {
+	_, err := os.Stat(filepath.Join(bundlePath, startedMarkerFilename))
+	return err == nil
+}
+
+func (s *containerSupervisor) finished(exitCode int) {
+	now := time.Now()
+	s.record.Finished = &now
+	s.record.ExitCode = &exitCode
+	err := s.record.write(s.dir)
+	if err != nil {
+		logError("%v", err)
+	}
+}
+
+func containersDirectory(ctx subcommandContext) (string, error) {
+	stateDir, err := stateDirectory(ctx.conf, ctx.variables)
+	if err != nil {
+		return "", fmt.Errorf("failed to find state directory: %w", err)
+	}
+	return filepath.Join(stateDir, containersDirectoryName), nil
+}
+
+func runPs(ctx subcommandContext, args []string) int {
+	flags := flag.NewFlagSet("ps", flag.ContinueOnError)
+	all := flags.Bool("a", false, "show containers that have exited too")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s ps [-a]\n", fsarkName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	containersDir, err := containersDirectory(ctx)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	containers, err := listDetachedContainers(containersDir)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "NAME\tCOMMAND\tSTATUS\tCREATED\tARGS\n")
+	for _, container := range containers {
+		if !*all && !container.running() {
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			container.Name,
+			container.Command,
+			container.status(),
+			container.Created.Local().Format(time.RFC3339),
+			strings.Join(container.Args, " "),
+		)
+	}
+	writer.Flush()
+	return 0
+}
+
+func runLogs(ctx subcommandContext, args []string) int {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing output until the container exits")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s logs [-f] <container>\n", fsarkName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	containersDir, err := containersDirectory(ctx)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	container, err := findDetachedContainer(containersDir, flags.Arg(0))
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	dir := filepath.Join(containersDir, container.Name)
+
+	stdout, err := os.Open(filepath.Join(dir, stdoutLogFilename))
+	if err != nil {
+		logError("Failed to open log: %v", err)
+		return 1
+	}
+	defer stdout.Close()
+	stderr, err := os.Open(filepath.Join(dir, stderrLogFilename))
+	if err != nil {
+		logError("Failed to open log: %v", err)
+		return 1
+	}
+	defer stderr.Close()
+
+	for {
+		// check before copying, so that once it has exited we still get
+		// everything it wrote
+		running := *follow && container.running()
+		if _, err := io.Copy(os.Stdout, stdout); err != nil {
+			logError("Failed to read log: %v", err)
+			return 1
+		}
+		if _, err := io.Copy(os.Stderr, stderr); err != nil {
+			logError("Failed to read log: %v", err)
+			return 1
+		}
+		if !running {
+			return 0
+		}
+
+		select {
+		case sig := <-ctx.signals:
+			if isTerminatingSignal(sig) {
+				return 0
+			}
+		case <-time.After(containerPollInterval):
+		}
+		container, err = readDetachedContainer(dir)
+		if err != nil {
+			logError("%v", err)
+			return 1
+		}
+	}
+}
+
+func runStop(ctx subcommandContext, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s stop <container>...\n", fsarkName)
+		return 2
+	}
+	containersDir, err := containersDirectory(ctx)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	retcode := 0
+	for _, name := range args {
+		container, err := findDetachedContainer(containersDir, name)
+		if err != nil {
+			logError("%v", err)
+			retcode = 1
+			continue
+		}
+		if container.running() {
+			// a supervisor that has only just started may not have recorded
+			// its PID yet
+			container, err = pollContainer(containersDir, container, func(c detachedContainer) bool {
+				return c.PID != 0 || !c.running()
+			})
+			if err != nil {
+				logError("Failed waiting for %v: %v", container.Name, err)
+				retcode = 1
+				continue
+			}
+		}
+		if container.running() {
+			// The supervisor passes this on to the container, and kills it
+			// if it doesn't exit within the grace period
+			err = syscall.Kill(container.PID, syscall.SIGTERM)
+			if err != nil && err != syscall.ESRCH {
+				logError("Failed to stop %v: %v", container.Name, err)
+				retcode = 1
+				continue
+			}
+			_, err = waitForExit(containersDir, container)
+			if err != nil {
+				logError("Failed waiting for %v: %v", container.Name, err)
+				retcode = 1
+				continue
+			}
+		}
+		fmt.Println(container.Name)
+	}
+	return retcode
+}
+
+func runWait(ctx subcommandContext, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s wait <container>...\n", fsarkName)
+		return 2
+	}
+	containersDir, err := containersDirectory(ctx)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	// Like the shell's wait, we exit with the exit code of the last one
+	retcode := 0
+	for _, name := range args {
+		container, err := findDetachedContainer(containersDir, name)
+		if err != nil {
+			logError("%v", err)
+			retcode = 1
+			continue
+		}
+		container, err = waitForExit(containersDir, container)
+		if err != nil {
+			logError("Failed waiting for %v: %v", name, err)
+			retcode = 1
+			continue
+		}
+		if container.ExitCode == nil {
+			logError("Container %v exited without recording its exit code", container.Name)
+			retcode = 1
+			continue
+		}
+		fmt.Println(*container.ExitCode)
+		retcode = *container.ExitCode
+	}
+	return retcode
+}
+
+// removeDetachedContainer removes what's left of a container that has
+// exited. If its supervisor was killed its bundle and secrets will still be
+// there, and the bundle may have files owned by subordinate IDs.
+func removeDetachedContainer(containersDir string, container detachedContainer, mappings idMappings) error {
+	if container.Bundle != "" {
+		os.RemoveAll(secretsDirectoryForBundle(container.Bundle))
+		err := removeMapped(container.Bundle, mappings)
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(containersDir, container.Name))
+}
+
+func runRm(ctx subcommandContext, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s rm <container>...\n", fsarkName)
+		return 2
+	}
+	containersDir, err := containersDirectory(ctx)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	retcode := 0
+	for _, name := range args {
+		container, err := findDetachedContainer(containersDir, name)
+		if err != nil {
+			logError("%v", err)
+			retcode = 1
+			continue
+		}
+		if container.running() {
+			logError("Container %v is still running, stop it first", container.Name)
+			retcode = 1
+			continue
+		}
+		mappings, err := resolveIDMappings()
+		if err == nil {
+			err = removeDetachedContainer(containersDir, container, mappings)
+		}
+		if err != nil {
+			logError("Failed to remove %v: %v", container.Name, err)
+			retcode = 1
+			continue
+		}
+		fmt.Println(container.Name)
+	}
+	return retcode
+}
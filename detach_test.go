@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCreateContainerDirectory(t *testing.T) {
+	containersDir := t.TempDir()
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		name, dir, err := createContainerDirectory(containersDir, "tileserver")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(name, "tileserver-") || len(name) != len("tileserver-")+6 {
+			t.Errorf("Unexpected container name %v", name)
+		}
+		if dir != filepath.Join(containersDir, name) {
+			t.Errorf("Expected directory for %v in %v, got %v", name, containersDir, dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("Expected %v to be created", dir)
+		}
+		if seen[name] {
+			t.Errorf("Container name %v used twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestFindDetachedContainer(t *testing.T) {
+	containersDir := t.TempDir()
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{"train-aaaaaa", "train-aabbbb", "tiles-cccccc"}
+	for index, name := range names {
+		dir := filepath.Join(containersDir, name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		// make the last one the oldest, to check they're sorted
+		record := detachedContainer{
+			Name:    name,
+			Command: strings.Split(name, "-")[0],
+			Created: created.Add(time.Duration(len(names)-index) * time.Minute),
+		}
+		if err := record.write(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a container that's still being created has no record yet
+	if err := os.Mkdir(filepath.Join(containersDir, "train-dddddd"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	containers, err := listDetachedContainers(containersDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var listed []string
+	for _, container := range containers {
+		listed = append(listed, container.Name)
+	}
+	expected := "tiles-cccccc train-aabbbb train-aaaaaa"
+	if strings.Join(listed, " ") != expected {
+		t.Errorf("Expected containers %v, got %v", expected, listed)
+	}
+
+	testcases := []struct {
+		Name     string
+		Expected string
+	}{
+		{"train-aaaaaa", "train-aaaaaa"},
+		{"train-aab", "train-aabbbb"},
+		{"tiles", "tiles-cccccc"},
+		{"train-aa", ""},
+		{"train-dddddd", ""},
+		{"other", ""},
+	}
+	for _, testcase := range testcases {
+		container, err := findDetachedContainer(containersDir, testcase.Name)
+		if testcase.Expected == "" {
+			if err == nil {
+				t.Errorf("Expected error finding %v, got %v", testcase.Name, container.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error finding %v: %v", testcase.Name, err)
+			continue
+		}
+		if container.Name != testcase.Expected {
+			t.Errorf("Expected %v to find %v, got %v", testcase.Name, testcase.Expected, container.Name)
+		}
+	}
+
+	if containers, err := listDetachedContainers(filepath.Join(containersDir, "missing")); err != nil || len(containers) != 0 {
+		t.Errorf("Expected no containers and no error for a missing directory, got %v, %v", containers, err)
+	}
+}
+
+func TestDetachedContainerStatus(t *testing.T) {
+	alive := t.TempDir()
+	lock, err := lockSupervisor(alive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	// a supervisor that was killed leaves its lock file behind, unlocked
+	dead := t.TempDir()
+	deadLock, err := lockSupervisor(dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLock.Close()
+
+	now := time.Now()
+	exitCode := 3
+	testcases := []struct {
+		Container detachedContainer
+		Status    string
+		Running   bool
+	}{
+		// before the supervisor has recorded its PID
+		{detachedContainer{dir: alive}, "starting", true},
+		{detachedContainer{dir: alive, PID: os.Getpid()}, "starting", true},
+		{detachedContainer{dir: alive, PID: os.Getpid(), Started: &now}, "running", true},
+		{detachedContainer{dir: dead, PID: os.Getpid(), Started: &now, Finished: &now, ExitCode: &exitCode}, "exited (3)", false},
+		// a live process with the same PID doesn't make it running
+		{detachedContainer{dir: dead, PID: os.Getpid(), Started: &now}, "dead", false},
+		{detachedContainer{dir: t.TempDir()}, "dead", false},
+	}
+	for _, testcase := range testcases {
+		if status := testcase.Container.status(); status != testcase.Status {
+			t.Errorf("Expected status %q for %+v, got %q", testcase.Status, testcase.Container, status)
+		}
+		if running := testcase.Container.running(); running != testcase.Running {
+			t.Errorf("Expected running %v for %+v, got %v", testcase.Running, testcase.Container, running)
+		}
+	}
+
+	// checking doesn't get in the way of the supervisor
+	if !supervisorAlive(alive) || !supervisorAlive(alive) {
+		t.Errorf("Expected supervisor to stay alive after being checked")
+	}
+}
+
+func TestRemoveDetachedContainer(t *testing.T) {
+	// keep the secrets directory for bundles within the bundle
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	containersDir := t.TempDir()
+	bundlesDir := t.TempDir()
+	name := "train-aaaaaa"
+	dir := filepath.Join(containersDir, name)
+	bundle := filepath.Join(bundlesDir, name)
+	for _, path := range []string{dir, filepath.Join(bundle, "rootfs")} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exitCode := 0
+	container := detachedContainer{Name: name, Bundle: bundle, ExitCode: &exitCode}
+	if err := container.write(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	err := removeDetachedContainer(containersDir, container, singleIDMappings(os.Getuid(), os.Getgid()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, path := range []string{dir, bundle} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %v to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestRunContainerStarted(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle")
+	if err := os.Mkdir(bundle, 0700); err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		Name     string
+		Script   string
+		ExitCode int
+		Started  bool
+	}{
+		// the runtime runs the hook and the container exits before we
+		// next look
+		{"quick", "touch " + filepath.Join(bundle, startedMarkerFilename) + "\nexit 3\n", 3, true},
+		{"failed", "exit 1\n", 1, false},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.Name, func(t *testing.T) {
+			os.Remove(filepath.Join(bundle, startedMarkerFilename))
+			path := filepath.Join(dir, "runc")
+			script := "#!/bin/sh\n[ \"$1\" = run ] || exit 0\n" + testcase.Script
+			if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			runtime := ociRuntime{name: "runc", path: path}
+
+			started := 0
+			code, err := runContainer(runtime, bundle, "test", false, make(chan os.Signal), time.Second, 0, func() { started++ })
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if code != testcase.ExitCode {
+				t.Errorf("Expected exit code %d, got %d", testcase.ExitCode, code)
+			}
+			if (started == 1) != testcase.Started || started > 1 {
+				t.Errorf("Expected started %v, got called %d times", testcase.Started, started)
+			}
+		})
+	}
+
+	var spec specs.Spec
+	if err := addStartedHook(&spec); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if spec.Hooks == nil || len(spec.Hooks.Poststart) != 1 || spec.Hooks.Poststart[0].Env[0] != hookEnvironmentVariable+"="+startedHookName {
+		t.Errorf("Expected a poststart hook, got %+v", spec.Hooks)
+	}
+}
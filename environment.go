@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// The environment given to the container is assembled from several sources,
+// with later sources taking precedence over earlier ones:
+//
+//  1. host variables matching the global pass_environment list in Config
+//  2. host variables matching the command's pass_environment list
+//  3. values from ~/.env if the command has allow_dot_env set
+//  4. values from the nearest .env file found by searching from the current
+//     directory upwards, if the command has dot_env_search set
+//  5. values from each of the command's env_files, in order
+//  6. the command's environment map from the config
+//
+// The USER and FSARK_* variables that fsark sets itself are added on top of
+// this when the container is built.
+
+const defaultDotEnvFilename = ".env"
+
+func validateEnvironmentPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("empty pass_environment pattern")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pass_environment pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func matchesEnvironmentPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		// patterns are validated before use, so we can ignore the error
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func passthroughEnvironment(hostEnvironment []string, patterns []string) map[string]string {
+	passed := make(map[string]string)
+	if len(patterns) == 0 {
+		return passed
+	}
+	for _, item := range hostEnvironment {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if matchesEnvironmentPattern(parts[0], patterns) {
+			passed[parts[0]] = parts[1]
+		}
+	}
+	return passed
+}
+
+func findDotEnv(cwd string, filename string) (string, bool) {
+	dir := filepath.Clean(cwd)
+	for {
+		candidate := filepath.Join(dir, filename)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+func resolveEnvironment(conf Config, commandConfig Wrapper, cwd string) (map[string]string, error) {
+	patterns := append([]string{}, conf.PassEnvironment...)
+	patterns = append(patterns, commandConfig.PassEnvironment...)
+	if err := validateEnvironmentPatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	env := passthroughEnvironment(os.Environ(), patterns)
+
+	if commandConfig.AllowDotEnv {
+		dotenv, err := godotenv.Read(filepath.Join(os.Getenv("HOME"), ".env"))
+		if err == nil {
+			for key, value := range dotenv {
+				env[key] = value
+			}
+		}
+	}
+
+	if commandConfig.DotEnvSearch {
+		filename := commandConfig.DotEnvFilename
+		if filename == "" {
+			filename = defaultDotEnvFilename
+		}
+		if strings.ContainsRune(filename, '/') {
+			return nil, fmt.Errorf("dot_env_filename must be a plain file name, got %q", filename)
+		}
+		if dotEnvPath, ok := findDotEnv(cwd, filename); ok {
+			dotenv, err := godotenv.Read(dotEnvPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %v: %w", dotEnvPath, err)
+			}
+			for key, value := range dotenv {
+				env[key] = value
+			}
+		}
+	}
+
+	for _, envFile := range commandConfig.EnvFiles {
+		if !filepath.IsAbs(envFile) {
+			envFile = filepath.Join(cwd, envFile)
+		}
+		values, err := godotenv.Read(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file %v: %w", envFile, err)
+		}
+		for key, value := range values {
+			env[key] = value
+		}
+	}
+
+	for key, value := range commandConfig.Environment {
+		env[key] = value
+	}
+
+	return env, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPassthroughEnvironment(t *testing.T) {
+	host := []string{
+		"TERM=xterm-256color",
+		"LANG=en_GB.UTF-8",
+		"SLURM_JOB_ID=1234",
+		"SLURM_NTASKS=4",
+		"SECRET_TOKEN=abcd",
+		"EMPTY=",
+	}
+	patterns := []string{"TERM", "LANG", "SLURM_*", "EMPTY"}
+
+	passed := passthroughEnvironment(host, patterns)
+	expected := map[string]string{
+		"TERM":         "xterm-256color",
+		"LANG":         "en_GB.UTF-8",
+		"SLURM_JOB_ID": "1234",
+		"SLURM_NTASKS": "4",
+		"EMPTY":        "",
+	}
+	if len(passed) != len(expected) {
+		t.Errorf("Expected %d variables, got %d: %v", len(expected), len(passed), passed)
+	}
+	for key, value := range expected {
+		if actual, ok := passed[key]; !ok || actual != value {
+			t.Errorf("Expected %s=%q, got %q (present=%t)", key, value, actual, ok)
+		}
+	}
+}
+
+func TestValidateEnvironmentPatterns(t *testing.T) {
+	if err := validateEnvironmentPatterns([]string{"TERM", "SLURM_*", "LC_?"}); err != nil {
+		t.Errorf("Unexpected error for valid patterns: %v", err)
+	}
+	if err := validateEnvironmentPatterns([]string{"BAD["}); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+	if err := validateEnvironmentPatterns([]string{""}); err == nil {
+		t.Errorf("Expected error for empty pattern")
+	}
+}
+
+func TestFindDotEnv(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "project")
+	nested := filepath.Join(project, "src", "module")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dotenvPath := filepath.Join(project, ".env")
+	if err := os.WriteFile(dotenvPath, []byte("KEY=value\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok := findDotEnv(nested, ".env")
+	if !ok {
+		t.Fatalf("Expected to find %v from %v", dotenvPath, nested)
+	}
+	if found != dotenvPath {
+		t.Errorf("Expected %v, got %v", dotenvPath, found)
+	}
+
+	if _, ok := findDotEnv(nested, ".env.fsark-test-missing"); ok {
+		t.Errorf("Expected not to find missing env file")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fsark exec runs another process in a running container, such as a shell
+// to debug it, using the runtime's exec command. The container can be a
+// detached one, or that of a command being run in the foreground, which is
+// found from the record of its run. The process gets the same environment,
+// working directory, user and restrictions as the container's own, and a
+// terminal if we're being used interactively.
+
+var defaultExecArgs = []string{"/bin/sh"}
+
+// runtimeRecord is what is kept about the runtime a container was run with,
+// so that we can run it against the container again.
+type runtimeRecord struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Flags []string `json:"flags,omitempty"`
+}
+
+func newRuntimeRecord(runtime ociRuntime) runtimeRecord {
+	return runtimeRecord{
+		Name:  runtime.name,
+		Path:  runtime.path,
+		Flags: runtime.globalFlags,
+	}
+}
+
+func (r runtimeRecord) runtime() ociRuntime {
+	return ociRuntime{
+		name:        r.Name,
+		path:        r.Path,
+		globalFlags: r.Flags,
+	}
+}
+
+// execProcess derives the process to exec from that of the container. If the
+// container runs under init then so does the process, so that it too gets
+// signals sent to both fsark and the runtime only once.
+func execProcess(container specs.Process, args []string, terminal bool) specs.Process {
+	process := container
+	if len(container.Args) > 0 && container.Args[0] == initPath {
+		args = append([]string{initPath, "--"}, args...)
+	}
+	process.Args = args
+	process.Terminal = terminal
+	process.ConsoleSize = nil
+	return process
+}
+
+// execArgs returns the arguments to the runtime to run the process described
+// in processPath in the container in the foreground.
+func execArgs(processPath string, socketPath string, id string, terminal bool) []string {
+	args := []string{"exec", "--process", processPath}
+	if terminal {
+		args = append(args, "--console-socket", socketPath)
+	}
+	return append(args, id)
+}
+
+// execInContainer runs the process and returns its exit code. Unlike
+// runContainer, signals are passed to the runtime rather than sent with its
+// kill command, as that would send them to the container's own process, and
+// the runtime passes them on to the process it exec'd.
+func execInContainer(runtime ociRuntime, id string, processPath string, socketPath string, terminal bool, signals <-chan os.Signal) (int, error) {
+	var listener *net.UnixListener
+	if terminal {
+		var err error
+		listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+		if err != nil {
+			return 1, fmt.Errorf("failed to create console socket: %w", err)
+		}
+		defer listener.Close()
+	}
+
+	cmd := runtime.command(execArgs(processPath, socketPath, id, terminal)...)
+	cmd.Stderr = os.Stderr
+	if !terminal {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+	}
+	separateRuntime(cmd, terminal)
+
+	err := cmd.Start()
+	if err != nil {
+		return 1, fmt.Errorf("failed to run %s: %w", runtime.name, err)
+	}
+
+	waitResult := make(chan error, 1)
+	go func() {
+		waitResult <- cmd.Wait()
+	}()
+
+	type consoleResult struct {
+		console *os.File
+		err     error
+	}
+	consoleReady := make(chan consoleResult, 1)
+	proxyDone := make(chan error, 1)
+	proxying := false
+	if terminal {
+		go func() {
+			console, err := receiveConsole(listener)
+			consoleReady <- consoleResult{console, err}
+		}()
+	}
+
+	for {
+		select {
+		case result := <-consoleReady:
+			if result.err != nil {
+				cmd.Process.Kill()
+				<-waitResult
+				return 1, result.err
+			}
+			proxying = true
+			go func() {
+				proxyDone <- proxyConsole(result.console)
+				result.console.Close()
+			}()
+
+		case sig := <-signals:
+			if err := cmd.Process.Signal(sig); err != nil {
+				logWarning("Failed to forward %v to process: %v", sig, err)
+			}
+
+		case err := <-waitResult:
+			if proxying {
+				if proxyErr := <-proxyDone; proxyErr != nil {
+					logError("Console error: %v", proxyErr)
+				}
+			}
+			return exitCodeFromError(err)
+		}
+	}
+}
+
+// execTarget is a running container to exec in.
+type execTarget struct {
+	id      string
+	bundle  string
+	runtime runtimeRecord
+}
+
+// findExecTarget looks up a detached container by its name, or failing that
+// a run in the foreground by its run ID, as passed to it in FSARK_RUN_ID,
+// its container ID or its command.
+func findExecTarget(ctx subcommandContext, name string) (execTarget, error) {
+	stateDir, err := stateDirectory(ctx.conf, ctx.variables)
+	if err != nil {
+		return execTarget{}, fmt.Errorf("failed to find state directory: %w", err)
+	}
+	container, err := findDetachedContainer(filepath.Join(stateDir, containersDirectoryName), name)
+	if err == nil {
+		if !container.running() || container.Started == nil || container.Runtime == nil || container.Bundle == "" {
+			return execTarget{}, fmt.Errorf("container %v is not running", container.Name)
+		}
+		return execTarget{id: container.Name, bundle: container.Bundle, runtime: *container.Runtime}, nil
+	}
+	if !errors.Is(err, errNoContainer) {
+		return execTarget{}, err
+	}
+	run, err := findActiveRun(filepath.Join(stateDir, runsDirectoryName), name)
+	if err != nil {
+		return execTarget{}, fmt.Errorf("no detached container named %v, and %w", name, err)
+	}
+	return execTarget{id: run.ID, bundle: run.Bundle, runtime: run.Runtime}, nil
+}
+
+func runExec(ctx subcommandContext, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s exec <container> [command] [arguments]\n", fsarkName)
+		return 2
+	}
+	command := args[1:]
+	if len(command) == 0 {
+		command = defaultExecArgs
+	}
+
+	container, err := findExecTarget(ctx, args[0])
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	content, err := os.ReadFile(filepath.Join(container.bundle, "config.json"))
+	if err != nil {
+		logError("Failed to read container spec: %v", err)
+		return 1
+	}
+	var spec specs.Spec
+	err = json.Unmarshal(content, &spec)
+	if err != nil {
+		logError("Failed to parse container spec: %v", err)
+		return 1
+	}
+	if spec.Process == nil {
+		logError("Container %v has no process in its spec", container.id)
+		return 1
+	}
+
+	terminal := isTerminal(os.Stdin) && isTerminal(os.Stdout)
+	process := execProcess(*spec.Process, command, terminal)
+
+	// the socket path has to be short, so this goes in the temporary
+	// directory rather than with the container
+	dir, err := os.MkdirTemp("", "fsark-exec-*")
+	if err != nil {
+		logError("Failed to create temporary directory: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	processPath := filepath.Join(dir, "process.json")
+	content, err = json.Marshal(process)
+	if err != nil {
+		logError("Failed to encode process: %v", err)
+		return 1
+	}
+	err = os.WriteFile(processPath, content, 0600)
+	if err != nil {
+		logError("Failed to write process: %v", err)
+		return 1
+	}
+
+	retcode, err := execInContainer(container.runtime.runtime(), container.id, processPath, consoleSocketPath(dir), terminal, ctx.signals)
+	if err != nil {
+		logError("Failed to exec in container %v: %v", container.id, err)
+	}
+	return retcode
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestExecProcess(t *testing.T) {
+	container := specs.Process{
+		Terminal:    false,
+		ConsoleSize: &specs.Box{Height: 24, Width: 80},
+		User:        specs.User{UID: 1000, GID: 1000},
+		Args:        []string{"python3", "train.py"},
+		Env:         []string{"PATH=/usr/bin:/bin", "HOME=/home/user"},
+		Cwd:         "/ark",
+		Capabilities: &specs.LinuxCapabilities{
+			Bounding: []string{"CAP_KILL"},
+		},
+		NoNewPrivileges: true,
+	}
+
+	process := execProcess(container, []string{"/bin/sh"}, true)
+	if !reflect.DeepEqual(process.Args, []string{"/bin/sh"}) {
+		t.Errorf("Expected args to be replaced, got %v", process.Args)
+	}
+	if !process.Terminal || process.ConsoleSize != nil {
+		t.Errorf("Expected a terminal without a fixed size, got %v and %v", process.Terminal, process.ConsoleSize)
+	}
+	if !reflect.DeepEqual(process.User, container.User) || process.Cwd != container.Cwd || !process.NoNewPrivileges {
+		t.Errorf("Expected user, cwd and restrictions to be kept, got %+v", process)
+	}
+	if !reflect.DeepEqual(process.Env, container.Env) || !reflect.DeepEqual(process.Capabilities, container.Capabilities) {
+		t.Errorf("Expected environment and capabilities to be kept, got %+v", process)
+	}
+	if !reflect.DeepEqual(container.Args, []string{"python3", "train.py"}) {
+		t.Errorf("Container's process was modified: %v", container.Args)
+	}
+
+	container.Args = []string{initPath, "--", "python3", "train.py"}
+	process = execProcess(container, []string{"/bin/sh"}, false)
+	if !reflect.DeepEqual(process.Args, []string{initPath, "--", "/bin/sh"}) {
+		t.Errorf("Expected process to be run under init, got %v", process.Args)
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	testcases := []struct {
+		Terminal bool
+		Expected []string
+	}{
+		{false, []string{"exec", "--process", "/tmp/x/process.json", "tiles-abc123"}},
+		{true, []string{"exec", "--process", "/tmp/x/process.json", "--console-socket", "/tmp/x/console.sock", "tiles-abc123"}},
+	}
+	for _, testcase := range testcases {
+		args := execArgs("/tmp/x/process.json", "/tmp/x/console.sock", "tiles-abc123", testcase.Terminal)
+		if !reflect.DeepEqual(args, testcase.Expected) {
+			t.Errorf("Expected %v with terminal %v, got %v", testcase.Expected, testcase.Terminal, args)
+		}
+	}
+}
+
+func TestRuntimeRecord(t *testing.T) {
+	runtime := ociRuntime{name: "runsc", path: "/usr/bin/runsc", globalFlags: []string{"--rootless", "--root", "/run/user/1000/runsc"}}
+	cmd := newRuntimeRecord(runtime).runtime().command("exec", "tiles-abc123")
+	expected := []string{"/usr/bin/runsc", "--rootless", "--root", "/run/user/1000/runsc", "exec", "tiles-abc123"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("Expected %v, got %v", expected, cmd.Args)
+	}
+}
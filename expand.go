@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Config values can refer to variables using either $NAME or ${NAME}, and
+// ${NAME:-default} can be used to provide a fallback for when NAME is not
+// set. A literal dollar sign is written as $$. Variables are looked up first
+// in the fsark defined set (see newExpansionVariables), and then in the host
+// environment.
+
+type expansionVariables struct {
+	fsark  map[string]string
+	strict bool
+}
+
+func newExpansionVariables(commandName string, cwd string, strict bool) expansionVariables {
+	home := os.Getenv("HOME")
+	username := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		if current.HomeDir != "" {
+			home = current.HomeDir
+		}
+		if current.Username != "" {
+			username = current.Username
+		}
+	}
+
+	return expansionVariables{
+		fsark: map[string]string{
+			"CWD":           cwd,
+			"HOME":          home,
+			"USER":          username,
+			"UID":           strconv.Itoa(os.Getuid()),
+			"GID":           strconv.Itoa(os.Getgid()),
+			"FSARK_COMMAND": commandName,
+		},
+		strict: strict,
+	}
+}
+
+func (v expansionVariables) lookup(name string) (string, bool) {
+	if value, ok := v.fsark[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+func isVariableNameChar(c byte, first bool) bool {
+	switch {
+	case c == '_':
+		return true
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	default:
+		return false
+	}
+}
+
+// expand replaces the variables in value. A $ that doesn't start a variable,
+// such as a trailing one or one in a regex or password, is an error if
+// expansion is strict, and is otherwise kept as it is, as it was before
+// variables were expanded.
+func (v expansionVariables) expand(value string) (string, error) {
+	var builder strings.Builder
+	for index := 0; index < len(value); index++ {
+		if value[index] != '$' {
+			builder.WriteByte(value[index])
+			continue
+		}
+		name, fallback, end, err := parseVariable(value, index)
+		if err != nil {
+			if v.strict {
+				return "", err
+			}
+			builder.WriteByte('$')
+			continue
+		}
+		index = end
+		if name == "" {
+			// $$
+			builder.WriteByte('$')
+			continue
+		}
+
+		expanded, ok := v.lookup(name)
+		if !ok {
+			switch {
+			case fallback != nil:
+				expanded = *fallback
+			case v.strict:
+				return "", fmt.Errorf("undefined variable %s in %q", name, value)
+			}
+		}
+		builder.WriteString(expanded)
+	}
+	return builder.String(), nil
+}
+
+// parseVariable parses the variable starting with the $ at index in value,
+// returning its name, its fallback if it has one, and the index of its last
+// character. The name is empty for $$.
+func parseVariable(value string, index int) (string, *string, int, error) {
+	if index+1 >= len(value) {
+		return "", nil, 0, fmt.Errorf("trailing $ in %q", value)
+	}
+
+	var name string
+	var fallback *string
+	var end int
+	switch next := value[index+1]; {
+	case next == '$':
+		return "", nil, index + 1, nil
+
+	case next == '{':
+		close := strings.IndexByte(value[index+2:], '}')
+		if close == -1 {
+			return "", nil, 0, fmt.Errorf("unterminated ${ in %q", value)
+		}
+		body := value[index+2 : index+2+close]
+		if parts := strings.SplitN(body, ":-", 2); len(parts) == 2 {
+			name = parts[0]
+			fallback = &parts[1]
+		} else {
+			name = body
+		}
+		end = index + 2 + close
+
+	case isVariableNameChar(next, true):
+		end = index + 1
+		for end < len(value) && isVariableNameChar(value[end], false) {
+			end += 1
+		}
+		name = value[index+1 : end]
+		end -= 1
+
+	default:
+		return "", nil, 0, fmt.Errorf("invalid character after $ in %q", value)
+	}
+
+	if name == "" {
+		return "", nil, 0, fmt.Errorf("empty variable name in %q", value)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVariableNameChar(name[i], i == 0) {
+			return "", nil, 0, fmt.Errorf("invalid variable name %q in %q", name, value)
+		}
+	}
+	return name, fallback, end, nil
+}
+
+func (v expansionVariables) expandList(values []string) ([]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	expanded := make([]string, len(values))
+	for index, value := range values {
+		result, err := v.expand(value)
+		if err != nil {
+			return nil, err
+		}
+		expanded[index] = result
+	}
+	return expanded, nil
+}
+
+func (w Wrapper) expandVariables(variables expansionVariables) (Wrapper, error) {
+	var err error
+	result := w
+
+	result.Command, err = variables.expand(w.Command)
+	if err != nil {
+		return Wrapper{}, fmt.Errorf("command: %w", err)
+	}
+	result.CommandArgs, err = variables.expandList(w.CommandArgs)
+	if err != nil {
+		return Wrapper{}, fmt.Errorf("command_start: %w", err)
+	}
+	result.MountsList, err = variables.expandList(w.MountsList)
+	if err != nil {
+		return Wrapper{}, fmt.Errorf("mounts: %w", err)
+	}
+
+	result.Seccomp, err = variables.expand(w.Seccomp)
+	if err != nil {
+		return Wrapper{}, fmt.Errorf("seccomp: %w", err)
+	}
+
+	result.EnvFiles, err = variables.expandList(w.EnvFiles)
+	if err != nil {
+		return Wrapper{}, fmt.Errorf("env_files: %w", err)
+	}
+
+	result.Secrets = make(map[string]string, len(w.Secrets))
+	for name, value := range w.Secrets {
+		result.Secrets[name], err = variables.expand(value)
+		if err != nil {
+			return Wrapper{}, fmt.Errorf("secret %s: %w", name, err)
+		}
+	}
+
+	result.Environment = make(map[string]string, len(w.Environment))
+	for key, value := range w.Environment {
+		result.Environment[key], err = variables.expand(value)
+		if err != nil {
+			return Wrapper{}, fmt.Errorf("environment %s: %w", key, err)
+		}
+	}
+
+	return result, nil
+}
+
+func (i Image) expandVariables(variables expansionVariables) (Image, error) {
+	var err error
+	result := i
+	result.ImageRootFSPath, err = variables.expand(i.ImageRootFSPath)
+	if err != nil {
+		return Image{}, fmt.Errorf("rootfs: %w", err)
+	}
+	return result, nil
+}
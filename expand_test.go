@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestExpandVariables(t *testing.T) {
+	variables := expansionVariables{
+		fsark: map[string]string{
+			"CWD":  "/home/alice/project",
+			"HOME": "/home/alice",
+			"USER": "alice",
+		},
+	}
+	t.Setenv("FSARK_TEST_HOST_VAR", "hostvalue")
+
+	testcases := []struct {
+		Value    string
+		Expected string
+	}{
+		{"/scratch", "/scratch"},
+		{"$HOME/data", "/home/alice/data"},
+		{"${USER}-cache", "alice-cache"},
+		{"${CWD}", "/home/alice/project"},
+		{"$FSARK_TEST_HOST_VAR", "hostvalue"},
+		{"${FSARK_TEST_UNSET_VAR:-fallback}", "fallback"},
+		{"${USER:-fallback}", "alice"},
+		{"cost: $$5", "cost: $5"},
+		{"$FSARK_TEST_UNSET_VAR", ""},
+		// a $ that doesn't start a variable is kept unless strict
+		{"^foo$", "^foo$"},
+		{`\$ `, `\$ `},
+		{"pa$-word$", "pa$-word$"},
+		{"${unterminated", "${unterminated"},
+		{"${not-a-name} $USER", "${not-a-name} alice"},
+	}
+	for _, testcase := range testcases {
+		result, err := variables.expand(testcase.Value)
+		if err != nil {
+			t.Errorf("Unexpected error expanding %q: %v", testcase.Value, err)
+			continue
+		}
+		if result != testcase.Expected {
+			t.Errorf("Expected %q, got %q", testcase.Expected, result)
+		}
+	}
+}
+
+func TestExpandVariablesErrors(t *testing.T) {
+	variables := expansionVariables{
+		fsark:  map[string]string{},
+		strict: true,
+	}
+
+	testcases := []string{
+		"$FSARK_TEST_UNSET_VAR",
+		"${FSARK_TEST_UNSET_VAR}",
+		"${unterminated",
+		"trailing $",
+		"${}",
+		"${not-a-name}",
+		"$-",
+	}
+	for _, testcase := range testcases {
+		if _, err := variables.expand(testcase); err == nil {
+			t.Errorf("Expected error expanding %q", testcase)
+		}
+	}
+}
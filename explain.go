@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Options for fsark itself can be given to a command either as arguments
+// with the reserved --fsark- prefix, which must come before any arguments for
+// the wrapped command, or through the environment. Anything after the first
+// argument without the prefix is passed to the command untouched. A "--"
+// after some fsark options also ends them, but one at the very start is
+// left for the command, as it was before fsark had options.
+
+const fsarkOptionPrefix = "--fsark-"
+
+type fsarkOptions struct {
+	dryRun     bool
+	keepBundle bool
+	detach     bool
+	verbose    bool
+}
+
+func environmentFlag(name string) (bool, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("bad value for %s %q: %w", name, value, err)
+	}
+	return enabled, nil
+}
+
+func parseFsarkOptions(args []string) (fsarkOptions, []string, error) {
+	var options fsarkOptions
+	var err error
+	options.dryRun, err = environmentFlag("FSARK_DRY_RUN")
+	if err != nil {
+		return fsarkOptions{}, nil, err
+	}
+	options.keepBundle, err = environmentFlag("FSARK_KEEP_BUNDLE")
+	if err != nil {
+		return fsarkOptions{}, nil, err
+	}
+	options.detach, err = environmentFlag("FSARK_DETACH")
+	if err != nil {
+		return fsarkOptions{}, nil, err
+	}
+
+	for index, arg := range args {
+		if arg == "--" && index > 0 {
+			return options, args[index+1:], nil
+		}
+		if !strings.HasPrefix(arg, fsarkOptionPrefix) {
+			return options, args[index:], nil
+		}
+		switch strings.TrimPrefix(arg, fsarkOptionPrefix) {
+		case "dry-run":
+			options.dryRun = true
+		case "keep-bundle":
+			options.keepBundle = true
+		case "detach":
+			options.detach = true
+		case "verbose":
+			options.verbose = true
+		default:
+			return fsarkOptions{}, nil, fmt.Errorf("unknown fsark option %v", arg)
+		}
+	}
+	return options, nil, nil
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`|&;<>()*?[]#~!{}") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// explainContainer writes out what would be run for a container, as a JSON
+// object containing the bundle path, the command line for the runtime, and
+// the spec.
+func explainContainer(out io.Writer, runtime ociRuntime, bundlePath string, id string, terminal bool, container builtContainer) error {
+	cmd := runtime.command(runArgs(bundlePath, id, terminal)...)
+	quoted := make([]string, len(cmd.Args))
+	for index, arg := range cmd.Args {
+		quoted[index] = shellQuote(arg)
+	}
+
+	explanation := struct {
+		Bundle         string     `json:"bundle"`
+		Image          string     `json:"image"`
+		RuntimeCommand []string   `json:"runtime_command"`
+		CommandLine    string     `json:"command_line"`
+		Spec           specs.Spec `json:"spec"`
+	}{
+		Bundle:         bundlePath,
+		Image:          container.ImagePath,
+		RuntimeCommand: cmd.Args,
+		CommandLine:    strings.Join(quoted, " "),
+		Spec:           container.Spec,
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(explanation)
+}
+
+func runExplain(ctx subcommandContext, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s explain [--fsark-keep-bundle] <command> [arguments]\n", fsarkName)
+		return 2
+	}
+
+	options, args, err := parseFsarkOptions(args)
+	if err != nil {
+		logError("%v", err)
+		return 2
+	}
+	if len(args) == 0 {
+		logError("No command given to explain")
+		return 2
+	}
+	options.dryRun = true
+
+	name := filepath.Base(args[0])
+	commandConfig, ok := ctx.conf.Commands[name]
+	if !ok {
+		logError("Configuration has no match for command %v", name)
+		return 1
+	}
+
+	return runCommand(invocation{
+		conf:          ctx.conf,
+		configData:    ctx.configData,
+		name:          name,
+		commandConfig: commandConfig,
+		args:          args[1:],
+		cwd:           ctx.variables.fsark["CWD"],
+		variables:     newExpansionVariables(name, ctx.variables.fsark["CWD"], ctx.conf.StrictExpansion),
+		signals:       ctx.signals,
+		options:       options,
+	})
+}
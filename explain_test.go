@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFsarkOptions(t *testing.T) {
+	testcases := []struct {
+		Args     []string
+		Options  fsarkOptions
+		Remained []string
+	}{
+		{[]string{"script.py", "--fsark-dry-run"}, fsarkOptions{}, []string{"script.py", "--fsark-dry-run"}},
+		{[]string{"--fsark-dry-run", "script.py"}, fsarkOptions{dryRun: true}, []string{"script.py"}},
+		{[]string{"--fsark-keep-bundle", "--fsark-dry-run"}, fsarkOptions{dryRun: true, keepBundle: true}, nil},
+		{[]string{"--fsark-keep-bundle", "--", "--fsark-dry-run"}, fsarkOptions{keepBundle: true}, []string{"--fsark-dry-run"}},
+		{[]string{"--", "--fsark-dry-run"}, fsarkOptions{}, []string{"--", "--fsark-dry-run"}},
+		{[]string{"--fsark-detach", "serve", "--port", "8080"}, fsarkOptions{detach: true}, []string{"serve", "--port", "8080"}},
+		{[]string{"--fsark-verbose", "--fsark-dry-run", "-v"}, fsarkOptions{dryRun: true, verbose: true}, []string{"-v"}},
+		{[]string{}, fsarkOptions{}, nil},
+	}
+	for _, testcase := range testcases {
+		options, remaining, err := parseFsarkOptions(testcase.Args)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", testcase.Args, err)
+			continue
+		}
+		if options != testcase.Options {
+			t.Errorf("Expected options %+v for %v, got %+v", testcase.Options, testcase.Args, options)
+		}
+		if len(remaining) != 0 || len(testcase.Remained) != 0 {
+			if !reflect.DeepEqual(remaining, testcase.Remained) {
+				t.Errorf("Expected remaining args %v for %v, got %v", testcase.Remained, testcase.Args, remaining)
+			}
+		}
+	}
+
+	if _, _, err := parseFsarkOptions([]string{"--fsark-unknown"}); err == nil {
+		t.Errorf("Expected error for unknown option")
+	}
+
+	t.Setenv("FSARK_DRY_RUN", "1")
+	options, _, err := parseFsarkOptions([]string{"script.py"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !options.dryRun {
+		t.Errorf("Expected FSARK_DRY_RUN to enable dry run")
+	}
+}
@@ -4,25 +4,48 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime/debug"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 
-	"github.com/joho/godotenv"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 type Wrapper struct {
-	ImageName   string            `json:"image"`
-	MountsList  []string          `json:"mounts"`
-	Environment map[string]string `json:"environment"`
-	AllowDotEnv bool              `json:"allow_dot_env"`
-	Command     string            `json:"command"`
-	CommandArgs []string          `json:"command_start"`
-	Networking  string            `json:"networking"`
+	ImageName       string            `json:"image"`
+	MountsList      []string          `json:"mounts"`
+	Environment     map[string]string `json:"environment"`
+	PassEnvironment []string          `json:"pass_environment"`
+	AllowDotEnv     bool              `json:"allow_dot_env"`
+	DotEnvSearch    bool              `json:"dot_env_search"`
+	DotEnvFilename  string            `json:"dot_env_filename"`
+	EnvFiles        []string          `json:"env_files"`
+	Secrets         map[string]string `json:"secrets"`
+	Command         string            `json:"command"`
+	CommandArgs     []string          `json:"command_start"`
+	Networking      string            `json:"networking"`
+	Ports           []string          `json:"ports"`
+	KillGracePeriod string            `json:"kill_grace_period"`
+	Timeout         string            `json:"timeout"`
+	Seccomp         string            `json:"seccomp"`
+	User            string            `json:"user"`
+	Home            string            `json:"home"`
+	Volumes         []string          `json:"volumes"`
+	ShmSize         string            `json:"shm_size"`
+	TmpSize         string            `json:"tmp_size"`
+	TmpExec         bool              `json:"tmp_exec"`
+	Tmpfs           []TmpfsConfig     `json:"tmpfs"`
+	CapAdd          []string          `json:"cap_add"`
+	CapDrop         []string          `json:"cap_drop"`
+	MaskedPaths     []string          `json:"masked_paths"`
+	ReadonlyPaths   []string          `json:"readonly_paths"`
+	NoNewPrivileges *bool             `json:"no_new_privileges"`
+	Init            *bool             `json:"init"`
+	TrackFiles      bool              `json:"track_files"`
+	Runtime         string            `json:"runtime"`
 }
 
 type Image struct {
@@ -31,82 +54,226 @@ type Image struct {
 }
 
 type Config struct {
-	Images   map[string]Image   `json:"images"`
-	Commands map[string]Wrapper `json:"commands"`
+	Images          map[string]Image         `json:"images"`
+	Commands        map[string]Wrapper       `json:"commands"`
+	PassEnvironment []string                 `json:"pass_environment"`
+	StrictExpansion bool                     `json:"strict_expansion"`
+	KillGracePeriod string                   `json:"kill_grace_period"`
+	Runtime         string                   `json:"runtime"`
+	Runtimes        map[string]RuntimeConfig `json:"runtimes"`
+	SlirpBackend    string                   `json:"slirp_backend"`
+	StateDirectory  string                   `json:"state_dir"`
+	Provenance      *ProvenanceConfig        `json:"provenance"`
+	Volumes         map[string]VolumeConfig  `json:"volumes"`
+	LogFile         string                   `json:"log_file"`
 }
 
 const configPath = "/var/ark/config.json"
 
+// killGracePeriod works out how long to give a container to exit after being
+// asked to stop before we kill it, with the command's setting taking
+// precedence over the global one.
+func killGracePeriod(conf Config, commandConfig Wrapper) (time.Duration, error) {
+	value := conf.KillGracePeriod
+	if commandConfig.KillGracePeriod != "" {
+		value = commandConfig.KillGracePeriod
+	}
+	if value == "" {
+		return defaultKillGracePeriod, nil
+	}
+	return parseDurationSetting("kill_grace_period", value)
+}
+
+// commandTimeout works out how long the command may run for, with the
+// FSARK_TIMEOUT environment variable taking precedence over the command's
+// setting. Zero means there is no limit.
+func commandTimeout(commandConfig Wrapper) (time.Duration, error) {
+	value := commandConfig.Timeout
+	name := "timeout"
+	if override, ok := os.LookupEnv("FSARK_TIMEOUT"); ok {
+		value = override
+		name = "FSARK_TIMEOUT"
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return parseDurationSetting(name, value)
+}
+
+// builtContainer describes a container bundle made by buildContainerInDir
+type builtContainer struct {
+	Spec       specs.Spec
+	BundlePath string
+	ImagePath  string
+	Mounts     []BindMount
+	// IDMappings are those of the container, and NamespaceMappings those
+	// of the namespace the rootfs is unpacked and removed in, which differ
+	// if the user keeps their own IDs in the container.
+	IDMappings        idMappings
+	NamespaceMappings idMappings
+	UserMode          string
+	ImageUser         string
+	HostUser          *containerUser
+}
+
 func (c Image) buildContainerInDir(
 	path string,
+	runID string,
 	args []string,
 	cwd string,
-	mountsList []string,
+	commandConfig Wrapper,
 	environment map[string]string,
-	networking string,
-) error {
+	slirpBackend string,
+	mappings idMappings,
+	home *BindMount,
+	volumes []BindMount,
+	terminal bool,
+) (builtContainer, error) {
 
 	rootImage, err := getImagePathForName(c.ImageRootFSPath)
 	if err != nil {
-		return err
+		return builtContainer{}, err
 	}
 
 	destRootFSPath := filepath.Join(path, "rootfs")
 
-	uid := os.Getuid()
-	gid := os.Getgid()
-
-	mounts := make([]BindMount, 1+len(mountsList))
+	mounts := make([]BindMount, 1+len(commandConfig.MountsList))
 	mounts[0] = BindMount{
 		Source:      cwd,
 		Destination: "/ark",
 	}
-	for index, path := range mountsList {
+	for index, path := range commandConfig.MountsList {
 		mounts[index+1] = BindMount{
 			Source:      path,
 			Destination: path,
 		}
 	}
 
+	if home != nil {
+		mounts = append(mounts, *home)
+	}
+	mounts = append(mounts, volumes...)
+
+	tmpfs, tmpfsMounts, err := commandConfig.tmpfsSettings()
+	if err != nil {
+		return builtContainer{}, err
+	}
+	secrets, err := secretMounts(path, commandConfig.Secrets)
+	if err != nil {
+		return builtContainer{}, err
+	}
+	if len(secrets) > 0 {
+		tmpfsMounts = append(tmpfsMounts, secretsTmpfsMount())
+		mounts = append(mounts, secrets...)
+	}
+
 	env := []string{
 		fmt.Sprintf("USER=%s", os.Getenv("USER")),
 		fmt.Sprintf("FSARK=%s", os.Args[0]),
+		fmt.Sprintf("FSARK_RUN_ID=%s", runID),
 	}
 	for key, value := range environment {
 		env = append(env, fmt.Sprintf("%s=%s", key, value))
 	}
+	if _, ok := environment["HOME"]; !ok && home != nil {
+		env = append(env, fmt.Sprintf("HOME=%s", home.Destination))
+	}
 
-	if info, ok := debug.ReadBuildInfo(); ok {
-		env = append(env, fmt.Sprintf("FSARK_PATH=%s", info.Main.Path))
-		env = append(env, fmt.Sprintf("FSARK_VERSION=%s", info.Main.Version))
-		for _, setting := range info.Settings {
-			env = append(env, fmt.Sprintf("FSARK_%s=%s", strings.ReplaceAll(strings.ToUpper(setting.Key), ".", "_"), setting.Value))
-		}
+	for key, value := range buildInfo() {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
 	}
 
 	// if we can, try read the config from the container image and add OCI labels to env
 	config, err := getContainerConfiguration(rootImage)
 	if (err != nil) && (err != io.EOF) {
-		return err
+		return builtContainer{}, err
 	}
 	for key, value := range config.Configuration.Labels {
 		env = append(env, fmt.Sprintf("%s=%s", strings.ReplaceAll(strings.ToUpper(key), ".", "_"), value))
 	}
 
+	network, err := prepareNetwork(path, commandConfig.Networking, commandConfig.Ports, slirpBackend)
+	if err != nil {
+		return builtContainer{}, err
+	}
+
+	security, err := commandConfig.securitySettings()
+	if err != nil {
+		return builtContainer{}, err
+	}
+
+	// The passwd and group overlays are made in the bundle, so we don't list
+	// them with the mounts the user asked for
+	specMounts := mounts
+	containerMappings := mappings
+	var hostUser *containerUser
+	if commandConfig.User == userModeHost {
+		current, err := hostContainerUser()
+		if err != nil {
+			return builtContainer{}, err
+		}
+		hostUser = &current
+		containerMappings, err = mappings.keepingID(int(current.UID), int(current.GID))
+		if err != nil {
+			return builtContainer{}, err
+		}
+		specMounts = append(append([]BindMount{}, mounts...), overlayMounts(path)...)
+	}
+
 	spec := CreateRootlessSpec(
 		args,
 		env,
 		"/ark",
 		destRootFSPath,
-		mounts,
-		uid,
-		gid,
-		networking == "host",
+		tmpfs,
+		tmpfsMounts,
+		specMounts,
+		containerMappings,
+		network,
+		security,
+		terminal,
 	)
+	if hostUser != nil {
+		applyContainerUser(&spec, *hostUser)
+	}
+	if commandConfig.initEnabled() {
+		executable, err := commandConfig.initExecutable()
+		if err != nil {
+			return builtContainer{}, err
+		}
+		if executable != "" {
+			logDebug("Running command under %v as init", executable)
+			applyInit(&spec, executable)
+		}
+	}
 
-	configPath := filepath.Join(path, "config.json")
+	container := builtContainer{
+		Spec:              spec,
+		BundlePath:        path,
+		ImagePath:         rootImage,
+		Mounts:            mounts,
+		IDMappings:        containerMappings,
+		NamespaceMappings: mappings,
+		UserMode:          commandConfig.User,
+		ImageUser:         config.Configuration.User,
+		HostUser:          hostUser,
+	}
+	err = container.writeSpec()
+	if err != nil {
+		return builtContainer{}, err
+	}
+	return container, nil
+}
 
-	content, err := json.Marshal(spec)
+func (b builtContainer) writeSpec() error {
+	err := validateSpec(b.Spec)
+	if err != nil {
+		return fmt.Errorf("generated an invalid container spec: %w", err)
+	}
+
+	configPath := filepath.Join(b.BundlePath, "config.json")
+
+	content, err := json.Marshal(b.Spec)
 	if err != nil {
 		return fmt.Errorf("failed to encode json spec: %w", err)
 	}
@@ -114,214 +281,572 @@ func (c Image) buildContainerInDir(
 	if err != nil {
 		return fmt.Errorf("failed to write spec file: %w", err)
 	}
+	logDebug("Wrote container spec to %v", configPath)
+	return nil
+}
 
-	err = os.MkdirAll(destRootFSPath, 0755)
+// unpack fills in the rootfs of the bundle from the image. This is kept
+// separate from building the bundle as it's the slow part, and isn't needed
+// if we're just showing what we would run. Anything that depends on the
+// contents of the image, such as which user to run as, is done here too.
+func (b *builtContainer) unpack() error {
+	err := os.MkdirAll(b.Spec.Root.Path, 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create rootfs directory: %w", err)
 	}
-	err = unpackRootFS(rootImage, destRootFSPath)
+	logDebug("Unpacking %v into %v", b.ImagePath, b.Spec.Root.Path)
+	started := time.Now()
+	if b.NamespaceMappings.multiRange() {
+		ownership, err := json.Marshal(ownershipMapping{Container: b.IDMappings, Namespace: b.NamespaceMappings})
+		if err != nil {
+			return fmt.Errorf("failed to encode ownership mapping: %w", err)
+		}
+		err = runInUserNamespace(b.NamespaceMappings, unpackHookName, b.ImagePath, b.Spec.Root.Path, string(ownership))
+	} else {
+		err = unpackRootFS(b.ImagePath, b.Spec.Root.Path, nil)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to clone rootfs: %w", err)
 	}
+	logDebug("Unpacked image in %v", time.Since(started).Round(time.Millisecond))
+
+	switch b.UserMode {
+	case userModeHost:
+		err = b.HostUser.writeOverlays(b.BundlePath, b.Spec.Root.Path)
+		if err != nil {
+			return err
+		}
+	case userModeImage:
+		imageUser, err := imageContainerUser(b.Spec.Root.Path, b.ImageUser)
+		if err != nil {
+			return err
+		}
+		applyContainerUser(&b.Spec, imageUser)
+		err = b.writeSpec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// previewUser works out the user that unpack would run the container as,
+// without unpacking the image, for a dry run to show.
+func (b *builtContainer) previewUser() error {
+	if b.UserMode != userModeImage {
+		return nil
+	}
+	imageUser, err := unpackedImageUser(b.ImagePath, b.ImageUser)
+	if err != nil {
+		return err
+	}
+	applyContainerUser(&b.Spec, imageUser)
 	return nil
 }
 
 func main() {
-	// If you os.Exit immediately, defers don't happen :(
-	retcode := 0
-	defer func(code *int) {
-		os.Exit(*code)
-	}(&retcode)
+	// If you os.Exit immediately, defers don't happen, so all the work is done
+	// in run, which cleans up after itself before we exit.
+	os.Exit(run())
+}
+
+func runHook(hook string) int {
+	var err error
+	switch hook {
+	case networkHookName:
+		err = runNetworkHook()
+	case unpackHookName:
+		err = runUnpackHook()
+	case removeHookName:
+		err = runRemoveHook()
+	case startedHookName:
+		err = runStartedHook()
+	default:
+		err = fmt.Errorf("unknown hook %q", hook)
+	}
+	if err != nil {
+		logError("fsark %s hook failed: %v", hook, err)
+		return 1
+	}
+	return 0
+}
+
+func run() (retcode int) {
+	if err := configureLogging(); err != nil {
+		logWarning("%v", err)
+	}
+
+	// fsark is also the init process in containers, where it's run under
+	// the name it's mounted as
+	if filepath.Base(os.Args[0]) == initName {
+		return runInit(os.Args[1:])
+	}
 
-	runcPath, err := exec.LookPath("runc")
+	// fsark is also used as a hook by the container runtime
+	if hook, ok := os.LookupEnv(hookEnvironmentVariable); ok {
+		return runHook(hook)
+	}
+
+	// Catch signals from the start so that we get to clean up if we're asked
+	// to stop whilst preparing the container, and once it's running they are
+	// forwarded to it.
+	signals := make(chan os.Signal, len(forwardedSignals))
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	configData, err := os.ReadFile(configPath)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to find runc on path")
+		logError("Failed to open %v: %v", configPath, err)
 		return
 	}
 
-	configFile, err := os.Open(configPath)
+	var conf Config
+	err = json.Unmarshal(configData, &conf)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to open %v: %v", configPath, err)
+		logError("Failed to parse config: %v", err)
+		return
+	}
+	err = conf.validate()
+	if err != nil {
+		retcode = 1
+		logError("Invalid config %v: %v", configPath, err)
 		return
 	}
 
-	var conf Config
-	err = json.NewDecoder(configFile).Decode(&conf)
+	cwd, err := os.Getwd()
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to parse config: %v", err)
+		logError("Failed to get current directory: %v", err)
 		return
 	}
 
 	// Find the matching name
 	_, exeName := filepath.Split(os.Args[0])
+	variables := newExpansionVariables(exeName, cwd, conf.StrictExpansion)
+	if conf.LogFile != "" && !fsarkLogger.hasFile() {
+		path, err := variables.expand(conf.LogFile)
+		if err == nil {
+			err = fsarkLogger.openFile(path)
+		}
+		if err != nil {
+			logWarning("Failed to use log_file: %v", err)
+		}
+	}
 	commandConfig, ok := conf.Commands[exeName]
+	if !ok && exeName == fsarkName {
+		ctx := subcommandContext{
+			conf:       conf,
+			configData: configData,
+			variables:  variables,
+			signals:    signals,
+		}
+		return runSubcommand(ctx, os.Args[1:])
+	}
 	if !ok {
 		retcode = 1
-		log.Printf("Configuration has no match for command %v, only:\n", exeName)
-		for key, _ := range conf.Commands {
-			log.Printf("\t* %v\n", key)
+		names := make([]string, 0, len(conf.Commands))
+		for key := range conf.Commands {
+			names = append(names, key)
 		}
+		sort.Strings(names)
+		logError("Configuration has no match for command %v, only: %v", exeName, strings.Join(names, ", "))
+		return
+	}
+
+	options, args, err := parseFsarkOptions(os.Args[1:])
+	if err != nil {
+		retcode = 1
+		logError("%v", err)
 		return
 	}
 
+	return runCommand(invocation{
+		conf:          conf,
+		configData:    configData,
+		name:          exeName,
+		commandConfig: commandConfig,
+		args:          args,
+		cwd:           cwd,
+		variables:     variables,
+		signals:       signals,
+		options:       options,
+	})
+}
+
+// invocation is everything needed to run a command from the config. If
+// replay is set then rather than args being added to the command from the
+// config, the arguments, image and working directory from the provenance
+// record are used instead.
+type invocation struct {
+	conf          Config
+	configData    []byte
+	name          string
+	commandConfig Wrapper
+	args          []string
+	cwd           string
+	variables     expansionVariables
+	signals       <-chan os.Signal
+	replay        *provenanceRecord
+	options       fsarkOptions
+}
+
+func runCommand(inv invocation) (retcode int) {
+	start := time.Now()
+	conf := inv.conf
+	exeName := inv.name
+	commandConfig := inv.commandConfig
+	cwd := inv.cwd
+	variables := inv.variables
+	if inv.options.verbose {
+		fsarkLogger.setLevel(levelDebug)
+	}
+
+	// When detaching we hand over to a copy of ourselves running in the
+	// background, which is told the container's name
+	var supervisor *containerSupervisor
+	if inv.options.detach && !inv.options.dryRun {
+		name, ok := os.LookupEnv(containerNameVariable)
+		if !ok {
+			return startDetached(inv)
+		}
+		var err error
+		supervisor, err = resumeSupervisor(conf, variables, name)
+		if err != nil {
+			retcode = 1
+			logError("Failed to start detached container %v: %v", name, err)
+			return
+		}
+		defer func() {
+			supervisor.finished(retcode)
+		}()
+	}
+
 	imageConfig, ok := conf.Images[commandConfig.ImageName]
 	if !ok {
 		retcode = 1
-		log.Printf("Configuration has no match for image %v, only:\n", commandConfig.ImageName)
+		names := make([]string, 0, len(conf.Images))
 		for key := range conf.Images {
-			log.Printf("\t* %v\n", key)
+			names = append(names, key)
 		}
+		sort.Strings(names)
+		logError("Configuration has no match for image %v, only: %v", commandConfig.ImageName, strings.Join(names, ", "))
 		return
 	}
 
-	dir, err := os.MkdirTemp("", "container-*")
+	commandConfig, err := commandConfig.expandVariables(variables)
+	if err != nil {
+		retcode = 1
+		logError("Failed to expand variables for command %v: %v", exeName, err)
+		return
+	}
+	imageConfig, err = imageConfig.expandVariables(variables)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to create temporary directory: %v", err)
+		logError("Failed to expand variables for image %v: %v", commandConfig.ImageName, err)
 		return
 	}
-	defer os.RemoveAll(dir)
+	if inv.replay != nil {
+		var warnings []string
+		imageConfig, warnings, err = pinReplayImage(imageConfig, *inv.replay, cacheDirectory(conf, variables, "digests"))
+		if err != nil {
+			retcode = 1
+			logError("Cannot replay run %v: %v", inv.replay.ID, err)
+			return
+		}
+		for _, warning := range warnings {
+			logWarning("%v", warning)
+		}
+	}
 
-	var args []string
-	if len(commandConfig.CommandArgs) > 1 {
-		args = append(commandConfig.CommandArgs, os.Args[1:]...)
-	} else {
-		args = append([]string{commandConfig.Command}, os.Args[1:]...)
+	runtime, err := resolveRuntime(conf, commandConfig, variables)
+	if err != nil {
+		retcode = 1
+		logError("Failed to find container runtime: %v", err)
+		return
 	}
+	err = runtime.checkRootless(cacheDirectory(conf, variables, "runtimes"))
+	if err != nil {
+		retcode = 1
+		logError("Container runtime unusable: %v", err)
+		return
+	}
+	logDebug("Using %v at %v as the container runtime", runtime.name, runtime.path)
 
-	env := commandConfig.Environment
-	if commandConfig.AllowDotEnv {
-		dotenv, err := godotenv.Read(filepath.Join(os.Getenv("HOME"), ".env"))
-		if err == nil {
-			for key, value := range dotenv {
-				// only add, don't replace
-				if _, ok := env[key]; !ok {
-					env[key] = value
-				}
+	mappings, err := resolveIDMappings()
+	if err != nil {
+		retcode = 1
+		logError("Failed to work out user namespace mappings: %v", err)
+		return
+	}
+	logDebug("Using user namespace mappings %v", mappings)
+
+	// Clean up after any earlier runs that were killed before they could do
+	// so themselves. Not being able to record runs isn't reason enough to
+	// stop this one. A dry run leaves all this alone, as it doesn't start
+	// anything that would need cleaning up after.
+	var runsDir string
+	if !inv.options.dryRun {
+		runsDir, err = stateSubdirectory(conf, variables, runsDirectoryName)
+		if err != nil {
+			logWarning("Not recording run: %v", err)
+			runsDir = ""
+		} else {
+			cleaned, err := cleanUpAbandonedRuns(runsDir, mappings)
+			if err != nil {
+				logWarning("Failed to clean up after abandoned runs: %v", err)
+			}
+			for _, record := range cleaned {
+				logInfo("Cleaned up after abandoned run %v of %v", record.ID, record.Command)
 			}
 		}
 	}
 
-	cwd, err := os.Getwd()
+	provenance, err := resolveProvenanceLocations(conf, variables)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to get current directory: %v", err)
+		logError("Failed to find where to record provenance: %v", err)
 		return
 	}
-	err = imageConfig.buildContainerInDir(
-		dir,
-		args,
-		cwd,
-		commandConfig.MountsList,
-		env,
-		commandConfig.Networking,
-	)
+	runID, err := newRunID()
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to create container: %v", err)
+		logError("%v", err)
 		return
 	}
 
+	// Detached containers keep their bundle with the rest of their state,
+	// and are known to the runtime by their name
+	var dir string
+	if supervisor != nil {
+		dir = supervisor.record.Bundle
+		err = os.Mkdir(dir, 0700)
+	} else {
+		dir, err = os.MkdirTemp("", "container-*")
+	}
+	if err != nil {
+		retcode = 1
+		logError("Failed to create container directory: %v", err)
+		return
+	}
 	_, id := filepath.Split(dir)
-	fullarglist := []string{runcPath, "run", "-b", dir, id}
+	if supervisor != nil {
+		id = supervisor.record.Name
+	}
+	if runsDir != "" {
+		run, err := recordRun(runsDir, runRecord{
+			ID:         id,
+			RunID:      runID,
+			Command:    exeName,
+			Bundle:     dir,
+			KeepBundle: inv.options.keepBundle,
+			PID:        os.Getpid(),
+			Started:    start,
+			Runtime:    newRuntimeRecord(runtime),
+		})
+		if err != nil {
+			logWarning("%v, so it can't be cleaned up after if fsark is killed", err)
+		} else {
+			defer run.release()
+		}
+	}
+	if inv.options.keepBundle {
+		defer logInfo("Keeping container bundle in %v", dir)
+	} else {
+		defer removeBundle(dir, mappings)
+	}
+	defer os.RemoveAll(secretsDirectoryForBundle(dir))
+	defer stopNetwork(dir)
 
-	cmd := &exec.Cmd{
-		Path:   runcPath,
-		Args:   fullarglist,
-		Stderr: os.Stderr,
+	var args []string
+	switch {
+	case inv.replay != nil:
+		args = inv.replay.Args
+	case len(commandConfig.CommandArgs) > 1:
+		args = append(commandConfig.CommandArgs, inv.args...)
+	default:
+		args = append([]string{commandConfig.Command}, inv.args...)
 	}
-	stdin, err := cmd.StdinPipe()
+
+	env, err := resolveEnvironment(conf, commandConfig, cwd)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to get input pipe: %v", err)
+		logError("Failed to build environment for command %v: %v", exeName, err)
 		return
 	}
-	defer stdin.Close()
-	stdout, err := cmd.StdoutPipe()
+
+	gracePeriod, err := killGracePeriod(conf, commandConfig)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to get output pipe: %v", err)
+		logError("Invalid configuration for command %v: %v", exeName, err)
 		return
 	}
-	defer stdout.Close()
 
-	err = cmd.Start()
+	home, err := resolveHomeMount(conf, exeName, commandConfig, variables)
 	if err != nil {
 		retcode = 1
-		log.Printf("Failed to run runc: %v", err)
+		logError("Failed to set up home directory for command %v: %v", exeName, err)
 		return
 	}
 
-	// Read from child, echo locally
-	var wgout sync.WaitGroup
-	wgout.Add(1)
-	go func() {
-		buffer := make([]byte, 1024)
-		for {
-			count, err := stdout.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from process: %v", err)
-				}
-				break
-			}
-			if count > 0 {
-				towrite := buffer[:count]
-				written_count, err := os.Stdout.Write(towrite)
-				if err != nil {
-					log.Printf("Failed to write to stdout: %v", err)
-					break
-				}
-				if written_count != count {
-					log.Fatalf("Michael should write better code: %v written, %v in buffer", written_count, count)
-				}
-			}
+	volumes, err := resolveVolumeMounts(conf, exeName, commandConfig, variables)
+	if err != nil {
+		retcode = 1
+		logError("Failed to set up volumes for command %v: %v", exeName, err)
+		return
+	}
+
+	timeout, err := commandTimeout(commandConfig)
+	if err != nil {
+		retcode = 1
+		logError("Invalid timeout for command %v: %v", exeName, err)
+		return
+	}
+
+	// Only give the container a terminal if we're being used interactively,
+	// otherwise we'd mangle the output of commands used in pipelines
+	terminal := isTerminal(os.Stdin) && isTerminal(os.Stdout)
+
+	container, err := imageConfig.buildContainerInDir(
+		dir,
+		runID,
+		args,
+		cwd,
+		commandConfig,
+		env,
+		conf.SlirpBackend,
+		mappings,
+		home,
+		volumes,
+		terminal,
+	)
+	if err != nil {
+		retcode = 1
+		logError("Failed to create container: %v", err)
+		return
+	}
+
+	if inv.replay != nil {
+		salt, err := environmentSalt(conf, variables)
+		if err != nil {
+			logWarning("Can't check environment variables against the run: %v", err)
 		}
-		wgout.Done()
-	}()
+		for _, warning := range compareReplay(*inv.replay, container, variables.fsark["USER"], salt) {
+			logWarning("%v", warning)
+		}
+	}
 
-	// Read from stdin, write to child. We don't have a wait group for this,
-	// just currently letting main exit and this will be reaped.
-	go func() {
-		buffer := make([]byte, 1024)
-		for {
-			count, err := os.Stdin.Read(buffer)
-			if err != nil {
-				log.Printf("Failed to read from stdin: %v", err)
-				break
-			}
-			if count > 0 {
-				towrite := buffer[0:count]
-				written_count, err := stdin.Write(towrite)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("Error writing to process: %v", err)
-					}
-					break
-				}
-				if written_count != count {
-					log.Fatalf("Michael should write better code: %v written, %v in buffer", written_count, count)
-				}
+	if inv.options.dryRun {
+		err = container.previewUser()
+		if err != nil {
+			retcode = 1
+			logError("Failed to find user for container: %v", err)
+			return
+		}
+		err = explainContainer(os.Stdout, runtime, dir, id, terminal, container)
+		if err != nil {
+			retcode = 1
+			logError("Failed to describe container: %v", err)
+		}
+		return
+	}
+
+	if supervisor != nil {
+		err = addStartedHook(&container.Spec)
+		if err == nil {
+			err = container.writeSpec()
+		}
+		if err != nil {
+			retcode = 1
+			logError("Failed to create container: %v", err)
+			return
+		}
+	}
+	err = stageSecrets(dir, commandConfig.Secrets)
+	if err != nil {
+		retcode = 1
+		logError("Failed to create container: %v", err)
+		return
+	}
+	err = container.unpack()
+	if err != nil {
+		retcode = 1
+		logError("Failed to create container: %v", err)
+		return
+	}
+
+	var before fileSnapshot
+	var unreadable []string
+	trackFiles := commandConfig.TrackFiles
+	if trackFiles {
+		before, unreadable, err = snapshotFiles(cwd, nil)
+		if err != nil {
+			logWarning("Not tracking files, as they couldn't be recorded before the run: %v", err)
+			trackFiles = false
+		}
+	}
+
+	var started func()
+	if supervisor != nil {
+		started = func() {
+			if err := supervisor.started(runtime); err != nil {
+				logError("%v", err)
 			}
 		}
-	}()
+	}
 
-	// wait for things to stop
-	wgout.Wait()
-	err = cmd.Wait()
+	retcode, err = runContainer(runtime, dir, id, terminal, inv.signals, gracePeriod, timeout, started)
 	if err != nil {
-		if proc_error, ok := err.(*exec.ExitError); ok {
-			// if the child exited with an error, just pass it on
-			retcode = proc_error.ExitCode()
-			return
+		logError("Failed to run container: %v", err)
+	}
+
+	if provenance.enabled() {
+		record := provenanceRecord{
+			ID:              runID,
+			Command:         exeName,
+			Args:            args,
+			Image:           commandConfig.ImageName,
+			ImageReference:  imageConfig.ImageRootFSPath,
+			ConfigPath:      configPath,
+			ConfigHash:      configHash(inv.configData),
+			Cwd:             cwd,
+			EnvironmentKeys: environmentKeys(container.Spec.Process.Env),
+			Mounts:          container.Mounts,
+			User:            variables.fsark["USER"],
+			Start:           start,
+			End:             time.Now(),
+			ExitCode:        retcode,
+			BuildInfo:       buildInfo(),
+		}
+		record.Host, _ = os.Hostname()
+		salt, err := environmentSalt(conf, variables)
+		if err != nil {
+			logWarning("Not recording hashes of environment variable values: %v", err)
 		} else {
-			retcode = 1
-			log.Printf("Failed to wait: %v", err)
-			return
+			record.EnvironmentHashes = environmentHashes(salt, container.Spec.Process.Env)
+			record.EnvironmentSalt = saltID(salt)
+		}
+		if inv.replay != nil {
+			record.ReplayOf = inv.replay.ID
+		}
+		record.ImageDigest, err = imageDigest(imageConfig.ImageRootFSPath, container.ImagePath, cacheDirectory(conf, variables, "digests"))
+		if err != nil {
+			logError("Failed to get image digest for provenance record: %v", err)
+		}
+		if trackFiles {
+			after, unreadableAfter, err := snapshotFiles(cwd, before)
+			if err != nil {
+				logError("Failed to record files after run: %v", err)
+			} else {
+				changes := compareSnapshots(before, after, append(unreadable, unreadableAfter...))
+				record.Files = &changes
+			}
+		}
+		err = provenance.write(record)
+		if err != nil {
+			logError("Failed to write provenance record: %v", err)
 		}
 	}
+	return
 }
@@ -2,7 +2,12 @@ module quantify.earth/fsark
 
 go 1.19
 
-require github.com/google/go-containerregistry v0.17.0
+require (
+	github.com/google/go-containerregistry v0.17.0
+	github.com/joho/godotenv v1.5.1
+	github.com/opencontainers/runtime-spec v1.2.0
+	golang.org/x/sys v0.8.0
+)
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.14.3 // indirect
@@ -10,7 +15,6 @@ require (
 	github.com/docker/distribution v2.8.2+incompatible // indirect
 	github.com/docker/docker v24.0.0+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.7.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/klauspost/compress v1.16.5 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
@@ -19,5 +23,4 @@ require (
 	github.com/sirupsen/logrus v1.9.1 // indirect
 	github.com/vbatts/tar-split v0.11.3 // indirect
 	golang.org/x/sync v0.2.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 )
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Commands can set home to give the container a home directory, which is
+// mounted at the same path as the invoking user's home directory on the
+// host, with HOME set to match:
+//
+//   - none: no home directory is mounted. This is the default.
+//   - readonly: the user's home directory, read only
+//   - readwrite: the user's home directory
+//   - isolated: a directory kept for the user and command in the fsark state
+//     directory, so that dotfiles and caches persist between runs of the
+//     command without it seeing the rest of the user's files
+
+const (
+	homeModeNone      = "none"
+	homeModeReadOnly  = "readonly"
+	homeModeReadWrite = "readwrite"
+	homeModeIsolated  = "isolated"
+)
+
+func validateHomeMode(mode string) error {
+	switch mode {
+	case "", homeModeNone, homeModeReadOnly, homeModeReadWrite, homeModeIsolated:
+		return nil
+	default:
+		return fmt.Errorf("unknown home %q, expected %s, %s, %s or %s", mode, homeModeNone, homeModeReadOnly, homeModeReadWrite, homeModeIsolated)
+	}
+}
+
+// resolveHomeMount returns the mount for the command's home directory, or
+// nil if it doesn't have one.
+func resolveHomeMount(conf Config, commandName string, commandConfig Wrapper, variables expansionVariables) (*BindMount, error) {
+	if commandConfig.Home == "" || commandConfig.Home == homeModeNone {
+		return nil, nil
+	}
+	home, _ := variables.lookup("HOME")
+	if home == "" {
+		return nil, fmt.Errorf("cannot mount home directory as HOME is not set")
+	}
+
+	switch commandConfig.Home {
+	case homeModeReadOnly:
+		return &BindMount{Source: home, Destination: home, ReadOnly: true}, nil
+	case homeModeReadWrite:
+		return &BindMount{Source: home, Destination: home}, nil
+	case homeModeIsolated:
+		username, _ := variables.lookup("USER")
+		dir, err := stateSubdirectory(conf, variables, filepath.Join("home", username, commandName))
+		if err != nil {
+			return nil, err
+		}
+		return &BindMount{Source: dir, Destination: home}, nil
+	default:
+		return nil, validateHomeMode(commandConfig.Home)
+	}
+}
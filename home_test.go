@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveHomeMount(t *testing.T) {
+	stateDir := t.TempDir()
+	conf := Config{StateDirectory: stateDir}
+	variables := expansionVariables{fsark: map[string]string{"HOME": "/home/alice", "USER": "alice"}}
+
+	testcases := []struct {
+		Home     string
+		Expected *BindMount
+	}{
+		{"", nil},
+		{"none", nil},
+		{"readonly", &BindMount{Source: "/home/alice", Destination: "/home/alice", ReadOnly: true}},
+		{"readwrite", &BindMount{Source: "/home/alice", Destination: "/home/alice"}},
+		{"isolated", &BindMount{Source: filepath.Join(stateDir, "home", "alice", "mytool"), Destination: "/home/alice"}},
+	}
+	for _, testcase := range testcases {
+		mount, err := resolveHomeMount(conf, "mytool", Wrapper{Home: testcase.Home}, variables)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Home, err)
+			continue
+		}
+		switch {
+		case testcase.Expected == nil && mount != nil:
+			t.Errorf("Expected no mount for %q, got %v", testcase.Home, *mount)
+		case testcase.Expected != nil && (mount == nil || *mount != *testcase.Expected):
+			t.Errorf("Expected %v for %q, got %v", *testcase.Expected, testcase.Home, mount)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(stateDir, "home", "alice", "mytool"))
+	if err != nil || !info.IsDir() {
+		t.Errorf("Expected isolated home directory to be created: %v", err)
+	}
+
+	if err := validateHomeMode("shared"); err == nil {
+		t.Errorf("Expected error for unknown home mode")
+	}
+}
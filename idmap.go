@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// By default the container's root is the invoking user, and no other IDs
+// exist in the container. If the user has subordinate IDs in /etc/subuid and
+// /etc/subgid then these are mapped to IDs 1 and up in the container as well,
+// so that files in the image keep their owners and tools can change user.
+//
+// Writing such a mapping needs the setuid newuidmap and newgidmap helpers,
+// which the runtime uses when it creates the container. The rootfs has to be
+// unpacked, and later removed, from within a user namespace with the same
+// mapping, as outside of it we can't create or remove files owned by the
+// subordinate IDs, so that is done by re-running fsark as a hook.
+
+const (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+
+	unpackHookName = "unpack"
+	removeHookName = "remove"
+
+	// set for a hook once the parent has written its ID mappings
+	userNamespaceReadyVariable = "FSARK_USERNS_READY"
+)
+
+type idRange struct {
+	Start uint32
+	Count uint32
+}
+
+type idMappings struct {
+	UIDs []specs.LinuxIDMapping
+	GIDs []specs.LinuxIDMapping
+}
+
+// String describes the mappings as container:host:size ranges, as in the
+// arguments to newuidmap.
+func (m idMappings) String() string {
+	describe := func(mappings []specs.LinuxIDMapping) string {
+		ranges := make([]string, len(mappings))
+		for i, mapping := range mappings {
+			ranges[i] = fmt.Sprintf("%d:%d:%d", mapping.ContainerID, mapping.HostID, mapping.Size)
+		}
+		return strings.Join(ranges, ",")
+	}
+	return fmt.Sprintf("uid %s gid %s", describe(m.UIDs), describe(m.GIDs))
+}
+
+// parseSubordinateIDs reads the ranges for a user from a file in the format
+// of /etc/subuid, where each line is the user's name or ID, the first
+// subordinate ID and the number of IDs.
+func parseSubordinateIDs(r io.Reader, name string, id int) ([]idRange, error) {
+	var ranges []idRange
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Split(text, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d: expected user:start:count", line)
+		}
+		if parts[0] != name && parts[0] != strconv.Itoa(id) {
+			continue
+		}
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad start %q: %w", line, parts[1], err)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad count %q: %w", line, parts[2], err)
+		}
+		if count > 0 {
+			ranges = append(ranges, idRange{Start: uint32(start), Count: uint32(count)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// buildIDMappings maps root in the container to the host ID, and the
+// subordinate ranges to consecutive IDs after that.
+func buildIDMappings(hostID int, ranges []idRange) []specs.LinuxIDMapping {
+	mappings := []specs.LinuxIDMapping{
+		{
+			ContainerID: 0,
+			HostID:      uint32(hostID),
+			Size:        1,
+		},
+	}
+	next := uint32(1)
+	for _, subordinate := range ranges {
+		mappings = append(mappings, specs.LinuxIDMapping{
+			ContainerID: next,
+			HostID:      subordinate.Start,
+			Size:        subordinate.Count,
+		})
+		next += subordinate.Count
+	}
+	return mappings
+}
+
+func singleIDMappings(uid int, gid int) idMappings {
+	return idMappings{
+		UIDs: buildIDMappings(uid, nil),
+		GIDs: buildIDMappings(gid, nil),
+	}
+}
+
+// multiRange is true if the mappings need newuidmap or newgidmap to set up.
+func (m idMappings) multiRange() bool {
+	return len(m.UIDs) > 1 || len(m.GIDs) > 1
+}
+
+// keepIDMapping maps an ID to itself in the container, and fills the IDs
+// either side of it from the subordinate ranges of a mapping made by
+// buildIDMappings.
+func keepIDMapping(hostID int, mappings []specs.LinuxIDMapping) []specs.LinuxIDMapping {
+	id := uint32(hostID)
+	var result []specs.LinuxIDMapping
+	next := uint32(0)
+	for _, mapping := range mappings {
+		if mapping.HostID == id && mapping.Size == 1 {
+			continue
+		}
+		hostStart := mapping.HostID
+		size := mapping.Size
+		if next < id && next+size > id {
+			// split the range around the ID we're keeping
+			below := id - next
+			result = append(result, specs.LinuxIDMapping{ContainerID: next, HostID: hostStart, Size: below})
+			hostStart += below
+			size -= below
+			next = id
+		}
+		if next == id {
+			next += 1
+		}
+		result = append(result, specs.LinuxIDMapping{ContainerID: next, HostID: hostStart, Size: size})
+		next += size
+	}
+	result = append(result, specs.LinuxIDMapping{ContainerID: id, HostID: id, Size: 1})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ContainerID < result[j].ContainerID
+	})
+	return result
+}
+
+// keepingID returns mappings in which the invoking user's IDs are the same
+// inside the container as outside, rather than being root. The runtime needs
+// root to be mapped as well, so unless the user is root this needs
+// subordinate IDs to map root to.
+func (m idMappings) keepingID(uid int, gid int) (idMappings, error) {
+	kept := idMappings{
+		UIDs: keepIDMapping(uid, m.UIDs),
+		GIDs: keepIDMapping(gid, m.GIDs),
+	}
+	_, uidOK := mapID(0, kept.UIDs)
+	_, gidOK := mapID(0, kept.GIDs)
+	if !uidOK || !gidOK {
+		return idMappings{}, fmt.Errorf("user %s needs subordinate IDs in /etc/subuid and /etc/subgid, and newuidmap and newgidmap to be installed, so that root in the container can be mapped as well as you", userModeHost)
+	}
+	return kept, nil
+}
+
+func mapID(id uint32, mappings []specs.LinuxIDMapping) (uint32, bool) {
+	for _, mapping := range mappings {
+		if id >= mapping.ContainerID && id-mapping.ContainerID < mapping.Size {
+			return mapping.HostID + (id - mapping.ContainerID), true
+		}
+	}
+	return 0, false
+}
+
+func unmapID(id uint32, mappings []specs.LinuxIDMapping) (uint32, bool) {
+	for _, mapping := range mappings {
+		if id >= mapping.HostID && id-mapping.HostID < mapping.Size {
+			return mapping.ContainerID + (id - mapping.HostID), true
+		}
+	}
+	return 0, false
+}
+
+// ownershipMapping describes how to give files the owners from the image
+// when unpacking in a user namespace whose mapping might not be the same as
+// the container's, as is the case when the user keeps their own ID.
+type ownershipMapping struct {
+	Container idMappings `json:"container"`
+	Namespace idMappings `json:"namespace"`
+}
+
+// translate turns IDs in the container into IDs in the namespace we're
+// unpacking in.
+func (o ownershipMapping) translate(uid int, gid int) (int, int, bool) {
+	if uid < 0 || gid < 0 {
+		return 0, 0, false
+	}
+	hostUID, ok := mapID(uint32(uid), o.Container.UIDs)
+	if !ok {
+		return 0, 0, false
+	}
+	hostGID, ok := mapID(uint32(gid), o.Container.GIDs)
+	if !ok {
+		return 0, 0, false
+	}
+	namespaceUID, ok := unmapID(hostUID, o.Namespace.UIDs)
+	if !ok {
+		return 0, 0, false
+	}
+	namespaceGID, ok := unmapID(hostGID, o.Namespace.GIDs)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(namespaceUID), int(namespaceGID), true
+}
+
+func readSubordinateIDs(path string, name string, id int) ([]idRange, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ranges, err := parseSubordinateIDs(file, name, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	return ranges, nil
+}
+
+// resolveIDMappings works out the mappings for the invoking user, falling
+// back to mapping just their own IDs if they have no subordinate IDs or the
+// helpers to use them aren't installed.
+func resolveIDMappings() (idMappings, error) {
+	uid := os.Getuid()
+	gid := os.Getgid()
+	single := singleIDMappings(uid, gid)
+
+	current, err := user.Current()
+	if err != nil {
+		return idMappings{}, fmt.Errorf("failed to look up current user: %w", err)
+	}
+	uidRanges, err := readSubordinateIDs(subuidPath, current.Username, uid)
+	if err != nil {
+		return idMappings{}, err
+	}
+	gidRanges, err := readSubordinateIDs(subgidPath, current.Username, uid)
+	if err != nil {
+		return idMappings{}, err
+	}
+	if len(uidRanges) == 0 || len(gidRanges) == 0 {
+		return single, nil
+	}
+
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			logWarning("You have subordinate IDs but %v is not installed, so only your own IDs will be mapped into the container", helper)
+			return single, nil
+		}
+	}
+
+	return idMappings{
+		UIDs: buildIDMappings(uid, uidRanges),
+		GIDs: buildIDMappings(gid, gidRanges),
+	}, nil
+}
+
+func writeIDMapping(helper string, pid int, mappings []specs.LinuxIDMapping) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, mapping := range mappings {
+		args = append(args,
+			strconv.FormatUint(uint64(mapping.ContainerID), 10),
+			strconv.FormatUint(uint64(mapping.HostID), 10),
+			strconv.FormatUint(uint64(mapping.Size), 10),
+		)
+	}
+	output, err := exec.Command(helper, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v failed: %w: %s", helper, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runInUserNamespace runs fsark as the given hook in a new user namespace
+// with the mappings. The hook waits for its stdin to be closed, which we do
+// once the mappings are written.
+func runInUserNamespace(mappings idMappings, hook string, args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find fsark executable: %w", err)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", hookEnvironmentVariable, hook))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+	}
+	ready, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start %v in user namespace: %w", hook, err)
+	}
+
+	err = writeIDMapping("newuidmap", cmd.Process.Pid, mappings.UIDs)
+	if err == nil {
+		err = writeIDMapping("newgidmap", cmd.Process.Pid, mappings.GIDs)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	ready.Close()
+
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%v in user namespace failed: %w", hook, err)
+	}
+	return nil
+}
+
+// enterUserNamespace is called at the start of hooks run by
+// runInUserNamespace. Once the mappings are written we have to exec again, as
+// we lost our capabilities in the namespace when we were first exec'd
+// before we were mapped to root.
+func enterUserNamespace() error {
+	if os.Getenv(userNamespaceReadyVariable) != "" {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed waiting for id mappings: %w", err)
+	}
+	err = os.Setenv(userNamespaceReadyVariable, "1")
+	if err != nil {
+		return err
+	}
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+func runUnpackHook() error {
+	if err := enterUserNamespace(); err != nil {
+		return err
+	}
+	if len(os.Args) != 4 {
+		return fmt.Errorf("expected image and rootfs paths and ownership mapping")
+	}
+	var ownership ownershipMapping
+	err := json.Unmarshal([]byte(os.Args[3]), &ownership)
+	if err != nil {
+		return fmt.Errorf("failed to parse ownership mapping: %w", err)
+	}
+	return unpackRootFS(os.Args[1], os.Args[2], &ownership)
+}
+
+func runRemoveHook() error {
+	if err := enterUserNamespace(); err != nil {
+		return err
+	}
+	if len(os.Args) != 2 {
+		return fmt.Errorf("expected path to remove")
+	}
+	return os.RemoveAll(os.Args[1])
+}
+
+// removeMapped removes a directory that may contain files owned by
+// subordinate IDs, which has to be done in a user namespace.
+func removeMapped(dir string, mappings idMappings) error {
+	var namespaceErr error
+	if mappings.multiRange() {
+		namespaceErr = runInUserNamespace(mappings, removeHookName, dir)
+	}
+	err := os.RemoveAll(dir)
+	if namespaceErr != nil {
+		return namespaceErr
+	}
+	return err
+}
+
+func removeBundle(dir string, mappings idMappings) {
+	err := removeMapped(dir, mappings)
+	if err != nil {
+		logError("Failed to remove container bundle %v: %v", dir, err)
+	}
+}
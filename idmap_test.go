@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseSubordinateIDs(t *testing.T) {
+	content := `# comment
+alice:100000:65536
+bob:165536:65536
+
+1000:300000:1000
+alice:400000:0
+`
+	testcases := []struct {
+		Name     string
+		ID       int
+		Expected []idRange
+	}{
+		{"alice", 1000, []idRange{{Start: 100000, Count: 65536}, {Start: 300000, Count: 1000}}},
+		{"bob", 1001, []idRange{{Start: 165536, Count: 65536}}},
+		{"carol", 1002, nil},
+	}
+	for _, testcase := range testcases {
+		ranges, err := parseSubordinateIDs(strings.NewReader(content), testcase.Name, testcase.ID)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", testcase.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, testcase.Expected) {
+			t.Errorf("Expected %v for %v, got %v", testcase.Expected, testcase.Name, ranges)
+		}
+	}
+
+	for _, invalid := range []string{"alice:100000", "alice:lots:65536", "alice:100000:-1"} {
+		if _, err := parseSubordinateIDs(strings.NewReader(invalid), "alice", 1000); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestBuildIDMappings(t *testing.T) {
+	mappings := buildIDMappings(1000, []idRange{{Start: 100000, Count: 65536}, {Start: 300000, Count: 1000}})
+	expected := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+		{ContainerID: 65537, HostID: 300000, Size: 1000},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("Expected %v, got %v", expected, mappings)
+	}
+
+	if singleIDMappings(1000, 1000).multiRange() {
+		t.Errorf("Expected single mappings not to be multi range")
+	}
+	if !(idMappings{UIDs: mappings, GIDs: buildIDMappings(1000, nil)}).multiRange() {
+		t.Errorf("Expected subordinate mappings to be multi range")
+	}
+
+	description := (idMappings{UIDs: mappings, GIDs: buildIDMappings(1000, nil)}).String()
+	if description != "uid 0:1000:1,1:100000:65536,65537:300000:1000 gid 0:1000:1" {
+		t.Errorf("Unexpected description of mappings %q", description)
+	}
+}
+
+func TestKeepIDMappings(t *testing.T) {
+	mappings := idMappings{
+		UIDs: buildIDMappings(1000, []idRange{{Start: 100000, Count: 65536}}),
+		GIDs: buildIDMappings(1000, []idRange{{Start: 200000, Count: 1000}}),
+	}
+	kept, err := mappings.keepingID(1000, 1000)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expectedUIDs := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+		{ContainerID: 1000, HostID: 1000, Size: 1},
+		{ContainerID: 1001, HostID: 101000, Size: 64536},
+	}
+	if !reflect.DeepEqual(kept.UIDs, expectedUIDs) {
+		t.Errorf("Expected uids %v, got %v", expectedUIDs, kept.UIDs)
+	}
+	expectedGIDs := []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: 200000, Size: 1000},
+		{ContainerID: 1000, HostID: 1000, Size: 1},
+	}
+	if !reflect.DeepEqual(kept.GIDs, expectedGIDs) {
+		t.Errorf("Expected gids %v, got %v", expectedGIDs, kept.GIDs)
+	}
+
+	// Unpacking happens with root as the user, so files owned by the user in
+	// the container must be made root owned in the namespace, and those owned
+	// by root in the container the first subordinate ID.
+	ownership := ownershipMapping{Container: kept, Namespace: mappings}
+	testcases := []struct {
+		UID      int
+		Expected int
+		OK       bool
+	}{
+		{1000, 0, true},
+		{0, 1, true},
+		{999, 1000, true},
+		{1001, 1001, true},
+		{70000, 0, false},
+	}
+	for _, testcase := range testcases {
+		uid, _, ok := ownership.translate(testcase.UID, 1000)
+		if ok != testcase.OK || (ok && uid != testcase.Expected) {
+			t.Errorf("Expected uid %d to translate to %d (%t), got %d (%t)", testcase.UID, testcase.Expected, testcase.OK, uid, ok)
+		}
+	}
+}
+
+func TestKeepIDMappingsWithoutSubordinateIDs(t *testing.T) {
+	// without subordinate IDs there's nothing to map root to
+	if _, err := singleIDMappings(1000, 1000).keepingID(1000, 1000); err == nil || !strings.Contains(err.Error(), "subordinate IDs") {
+		t.Errorf("Expected an error saying subordinate IDs are needed, got %v", err)
+	}
+	partial := idMappings{
+		UIDs: buildIDMappings(1000, []idRange{{Start: 100000, Count: 65536}}),
+		GIDs: buildIDMappings(1000, nil),
+	}
+	if _, err := partial.keepingID(1000, 1000); err == nil {
+		t.Errorf("Expected an error without subordinate gids")
+	}
+	// unless we're root already
+	kept, err := singleIDMappings(0, 0).keepingID(0, 0)
+	if err != nil {
+		t.Errorf("Unexpected error for root: %v", err)
+	}
+	if err == nil && !reflect.DeepEqual(kept, singleIDMappings(0, 0)) {
+		t.Errorf("Expected root's mapping to be unchanged, got %v", kept)
+	}
+}
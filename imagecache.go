@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
@@ -15,6 +19,7 @@ import (
 func getImagePathForName(imageName string) (string, error) {
 	_, err := os.Stat(imageName)
 	if err == nil {
+		logDebug("Using local image %v", imageName)
 		return imageName, nil
 	}
 	if !os.IsNotExist(err) {
@@ -35,14 +40,15 @@ func getImagePathForName(imageName string) (string, error) {
 		return "", err
 	}
 
+	logDebug("Fetching image %v from registry", ref)
 	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to fetch image %s: %w", imageName, err)
 	}
 
 	hash, err := img.Digest()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to get digest of image %s: %w", imageName, err)
 	}
 
 	imageMap := map[string]v1.Image{}
@@ -52,16 +58,66 @@ func getImagePathForName(imageName string) (string, error) {
 
 	_, err = os.Stat(path)
 	if err == nil {
+		logDebug("Using cached image %v for %v", path, imageName)
 		return path, nil
 	}
 	if !os.IsNotExist(err) {
 		return "", err
 	}
 
+	logDebug("Saving image %v to %v", imageName, path)
 	err = crane.MultiSave(imageMap, path)
 	if err != nil {
-		panic(fmt.Errorf("saving tarball %s: %w", path, err))
+		return "", fmt.Errorf("saving tarball %s: %w", path, err)
 	}
 
 	return path, err
 }
+
+// imageDigest returns a digest that identifies the image at imagePath, which
+// getImagePathForName resolved from imageName. For images fetched from a
+// registry this is the manifest digest, for docker image archives it is the
+// image ID, and for plain rootfs archives it is the hash of the archive.
+// Working this out for a local archive means reading through it, so the
+// result is kept in cacheDir until the archive changes.
+func imageDigest(imageName string, imagePath string, cacheDir string) (string, error) {
+	if imagePath != imageName {
+		// images fetched from a registry are cached by their digest
+		return fmt.Sprintf("sha256:%s", strings.TrimSuffix(path.Base(imagePath), ".tar")), nil
+	}
+
+	stamp, err := stampFile(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find image for hashing: %w", err)
+	}
+	if digest, ok := readCache(cacheDir, stamp); ok {
+		return digest, nil
+	}
+	digest, err := localImageDigest(imagePath)
+	if err != nil {
+		return "", err
+	}
+	writeCache(cacheDir, stamp, digest)
+	return digest, nil
+}
+
+func localImageDigest(imagePath string) (string, error) {
+	manifest, err := loadImageManifest(imagePath)
+	if err == nil {
+		return fmt.Sprintf("sha256:%s", manifest.Digest()), nil
+	}
+	if err != io.EOF {
+		return "", err
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image for hashing: %w", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash image: %w", err)
+	}
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Whatever runs as PID 1 in a pid namespace gets no default signal handlers,
+// so a command that doesn't set up its own ignores SIGTERM, and it inherits
+// every orphaned process in the container, which it's unlikely to reap. So
+// unless a command sets init to false, fsark mounts itself into the
+// container and runs as init there, much like tini: it starts the command,
+// passes on any signals it gets, reaps whatever exits, and exits with the
+// command's exit code once it's done.
+//
+// fsark can only do this if it's statically linked, as otherwise it
+// depends on the image having a compatible C library.
+
+const (
+	initPath = "/run/fsark-init"
+	initName = "fsark-init"
+)
+
+// signalRepeatWindow is how long init ignores a signal for after passing it
+// on. fsark forwards the signals it gets to the container, but when the
+// runtime has to share its process group a signal sent to the whole group,
+// such as Ctrl-C, also reaches the container through the runtime, and the
+// command should only see it once.
+const signalRepeatWindow = 200 * time.Millisecond
+
+// signalFilter drops a signal that arrives again within signalRepeatWindow
+// of the last time it was passed on.
+type signalFilter struct {
+	forwarded map[os.Signal]time.Time
+}
+
+func (f *signalFilter) repeated(sig os.Signal, now time.Time) bool {
+	if last, ok := f.forwarded[sig]; ok && now.Sub(last) < signalRepeatWindow {
+		return true
+	}
+	if f.forwarded == nil {
+		f.forwarded = make(map[os.Signal]time.Time)
+	}
+	f.forwarded[sig] = now
+	return false
+}
+
+// initEnabled is true unless the command has turned init off.
+func (w Wrapper) initEnabled() bool {
+	return w.Init == nil || *w.Init
+}
+
+func isStaticExecutable(path string) (bool, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %v: %w", path, err)
+	}
+	defer file.Close()
+	for _, prog := range file.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// initExecutable returns the path of fsark to mount into the container as
+// init, or an empty string if it can't be used and the command didn't
+// explicitly ask for init, in which case we warn, as a command that relies
+// on init may misbehave without it. Commands that set init to false never
+// get here, so that's how to quieten it.
+func (w Wrapper) initExecutable() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find fsark executable: %w", err)
+	}
+	static, err := isStaticExecutable(self)
+	if err != nil {
+		return "", err
+	}
+	if static {
+		return self, nil
+	}
+	if w.Init != nil {
+		return "", fmt.Errorf("fsark can't be used as init as it is dynamically linked, build it with CGO_ENABLED=0")
+	}
+	logWarning("Not running an init process in the container as fsark is dynamically linked, build it with make or CGO_ENABLED=0 to use one, or set \"init\": false for the command")
+	return "", nil
+}
+
+// applyInit makes the spec run the process under fsark as init, which is
+// mounted from the host.
+func applyInit(spec *specs.Spec, executable string) {
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: initPath,
+		Type:        "none",
+		Source:      executable,
+		Options: []string{
+			"bind",
+			"nosuid",
+			"nodev",
+			"ro",
+		},
+	})
+	spec.Process.Args = append([]string{initPath, "--"}, spec.Process.Args...)
+}
+
+// initExitCode converts a wait status into an exit code as a shell would.
+func initExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// runInit is the init process in the container. Any errors are reported with
+// the exit codes a shell would use for them.
+func runInit(args []string) int {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		logError("%s: no command given", initName)
+		return 2
+	}
+
+	// If we're not PID 1, say because the runtime put something in front
+	// of us, make sure orphans still come to us
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		logWarning("%s: failed to become subreaper: %v", initName, err)
+	}
+
+	// catch everything we can before the command starts, so that we don't
+	// miss it exiting
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		logError("%s: %v", initName, err)
+		if errors.Is(err, exec.ErrNotFound) {
+			return 127
+		}
+		return 126
+	}
+
+	// The command gets its own process group, which is put in the
+	// foreground if there's a terminal, so that signals from the keyboard
+	// go to it and don't reach it a second time through us.
+	start := func(foreground bool) (int, error) {
+		return syscall.ForkExec(path, args, &syscall.ProcAttr{
+			Env:   os.Environ(),
+			Files: []uintptr{0, 1, 2},
+			Sys: &syscall.SysProcAttr{
+				Setpgid:    true,
+				Foreground: foreground,
+				Ctty:       0,
+			},
+		})
+	}
+	pid, err := start(isTerminal(os.Stdin))
+	if err != nil && isTerminal(os.Stdin) {
+		// stdin may be a terminal that isn't ours to hand over
+		pid, err = start(false)
+	}
+	if err != nil {
+		logError("%s: failed to run %v: %v", initName, args[0], err)
+		return 126
+	}
+
+	var filter signalFilter
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGCHLD:
+			for {
+				var status syscall.WaitStatus
+				reaped, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+				if err == syscall.EINTR {
+					continue
+				}
+				if err != nil || reaped <= 0 {
+					break
+				}
+				// Once the command is done we are too, and anything left
+				// is killed along with the pid namespace when we exit
+				if reaped == pid && (status.Exited() || status.Signaled()) {
+					return initExitCode(status)
+				}
+			}
+		case syscall.SIGURG, syscall.SIGTTIN, syscall.SIGTTOU:
+			// the Go runtime uses SIGURG itself, and the terminal ones are
+			// about our own use of the terminal, not the command's
+		default:
+			if filter.repeated(sig, time.Now()) {
+				logDebug("%s: ignoring %v as it was just passed on", initName, sig)
+				continue
+			}
+			if err := syscall.Kill(pid, sig.(syscall.Signal)); err != nil && err != syscall.ESRCH {
+				logError("%s: failed to forward %v: %v", initName, sig, err)
+			}
+		}
+	}
+	return 1
+}
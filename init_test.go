@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyInit(t *testing.T) {
+	spec := specs.Spec{
+		Process: &specs.Process{Args: []string{"make", "-j8"}},
+		Mounts:  []specs.Mount{{Destination: "/proc", Type: "proc", Source: "proc"}},
+	}
+	applyInit(&spec, "/usr/local/bin/fsark")
+
+	expectedArgs := []string{initPath, "--", "make", "-j8"}
+	if !reflect.DeepEqual(spec.Process.Args, expectedArgs) {
+		t.Errorf("Expected args %v, got %v", expectedArgs, spec.Process.Args)
+	}
+	if len(spec.Mounts) != 2 {
+		t.Fatalf("Expected init to be mounted, got %v", spec.Mounts)
+	}
+	mount := spec.Mounts[1]
+	if mount.Destination != initPath || mount.Source != "/usr/local/bin/fsark" {
+		t.Errorf("Expected fsark mounted at %v, got %+v", initPath, mount)
+	}
+	for _, option := range mount.Options {
+		if option == "noexec" {
+			t.Errorf("Init must be executable, got options %v", mount.Options)
+		}
+	}
+	if filepath.Base(spec.Process.Args[0]) != initName {
+		t.Errorf("Expected init to be run as %v, got %v", initName, spec.Process.Args[0])
+	}
+}
+
+func TestInitEnabled(t *testing.T) {
+	enabled := true
+	disabled := false
+	testcases := []struct {
+		Init     *bool
+		Expected bool
+	}{
+		{nil, true},
+		{&enabled, true},
+		{&disabled, false},
+	}
+	for _, testcase := range testcases {
+		if result := (Wrapper{Init: testcase.Init}).initEnabled(); result != testcase.Expected {
+			t.Errorf("Expected %v for %v, got %v", testcase.Expected, testcase.Init, result)
+		}
+	}
+}
+
+func TestInitExitCode(t *testing.T) {
+	testcases := []struct {
+		Status   syscall.WaitStatus
+		Expected int
+	}{
+		{syscall.WaitStatus(0), 0},
+		{syscall.WaitStatus(3 << 8), 3},
+		{syscall.WaitStatus(syscall.SIGKILL), 137},
+		{syscall.WaitStatus(syscall.SIGTERM), 143},
+	}
+	for _, testcase := range testcases {
+		if code := initExitCode(testcase.Status); code != testcase.Expected {
+			t.Errorf("Expected exit code %d for status %#x, got %d", testcase.Expected, uint32(testcase.Status), code)
+		}
+	}
+}
+
+func TestSignalFilter(t *testing.T) {
+	var filter signalFilter
+	start := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	testcases := []struct {
+		Signal   os.Signal
+		After    time.Duration
+		Repeated bool
+	}{
+		{syscall.SIGINT, 0, false},
+		{syscall.SIGINT, 10 * time.Millisecond, true},
+		{syscall.SIGTERM, 20 * time.Millisecond, false},
+		{syscall.SIGINT, signalRepeatWindow, false},
+		{syscall.SIGINT, 2*signalRepeatWindow + time.Millisecond, false},
+	}
+	for _, testcase := range testcases {
+		if repeated := filter.repeated(testcase.Signal, start.Add(testcase.After)); repeated != testcase.Repeated {
+			t.Errorf("Expected %v after %v to be repeated %v, got %v", testcase.Signal, testcase.After, testcase.Repeated, repeated)
+		}
+	}
+}
+
+func TestIsStaticExecutable(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := isStaticExecutable(self); err != nil {
+		t.Errorf("Unexpected error checking %v: %v", self, err)
+	}
+
+	notExecutable := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := isStaticExecutable(notExecutable); err == nil {
+		t.Errorf("Expected error for a file that isn't an ELF executable")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsark's own messages go to stderr, or to the file named by FSARK_LOG_FILE
+// or log_file in the config, so that they never get mixed in with the
+// output of the command. Each has a level, and only those at or above
+// FSARK_LOG_LEVEL are written, which is info by default, so that debug
+// messages describing what fsark is doing only appear when asked for, such
+// as with --fsark-verbose. Setting FSARK_LOG_FORMAT to json writes each
+// message as a line of JSON rather than text.
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarning
+	levelInfo
+	levelDebug
+)
+
+const (
+	defaultLogLevel = levelInfo
+	logTimeFormat   = "2006/01/02 15:04:05"
+)
+
+var logLevelNames = map[logLevel]string{
+	levelError:   "error",
+	levelWarning: "warn",
+	levelInfo:    "info",
+	levelDebug:   "debug",
+}
+
+func parseLogLevel(value string) (logLevel, error) {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	if normalized == "warning" {
+		normalized = "warn"
+	}
+	for level, name := range logLevelNames {
+		if name == normalized {
+			return level, nil
+		}
+	}
+	return levelError, fmt.Errorf("unknown log level %q, expected error, warn, info or debug", value)
+}
+
+type logger struct {
+	lock   sync.Mutex
+	out    io.Writer
+	file   *os.File
+	level  logLevel
+	asJSON bool
+	now    func() time.Time
+}
+
+var fsarkLogger = &logger{
+	out:   os.Stderr,
+	level: defaultLogLevel,
+	now:   time.Now,
+}
+
+// configureLogging sets up logging from the environment. Problems are
+// returned after whatever could be set up has been, so they can be logged.
+func configureLogging() error {
+	var problems []string
+	if value, ok := os.LookupEnv("FSARK_LOG_LEVEL"); ok && value != "" {
+		level, err := parseLogLevel(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("FSARK_LOG_LEVEL: %v", err))
+		} else {
+			fsarkLogger.setLevel(level)
+		}
+	}
+	if value, ok := os.LookupEnv("FSARK_LOG_FORMAT"); ok && value != "" {
+		switch strings.ToLower(value) {
+		case "json":
+			fsarkLogger.asJSON = true
+		case "text":
+			fsarkLogger.asJSON = false
+		default:
+			problems = append(problems, fmt.Sprintf("FSARK_LOG_FORMAT: unknown format %q, expected text or json", value))
+		}
+	}
+	if path, ok := os.LookupEnv("FSARK_LOG_FILE"); ok && path != "" {
+		if err := fsarkLogger.openFile(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func (l *logger) setLevel(level logLevel) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level = level
+}
+
+// openFile makes messages go to the end of the file rather than to stderr.
+func (l *logger) openFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.out = file
+	return nil
+}
+
+func (l *logger) hasFile() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file != nil
+}
+
+func (l *logger) write(level logLevel, message string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if level > l.level {
+		return
+	}
+	now := l.now()
+	message = strings.TrimSuffix(message, "\n")
+	// so that you know why a command failed, errors always go to stderr
+	if l.file != nil && level == levelError {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", now.Format(logTimeFormat), logLevelNames[level], message)
+	}
+	if l.asJSON {
+		entry := struct {
+			Time    string `json:"time"`
+			Level   string `json:"level"`
+			Message string `json:"msg"`
+			PID     int    `json:"pid"`
+		}{
+			Time:    now.Format(time.RFC3339Nano),
+			Level:   logLevelNames[level],
+			Message: message,
+			PID:     os.Getpid(),
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		l.out.Write(append(line, '\n'))
+		return
+	}
+	fmt.Fprintf(l.out, "%s %s: %s\n", now.Format(logTimeFormat), logLevelNames[level], message)
+}
+
+func logError(format string, args ...interface{}) {
+	fsarkLogger.write(levelError, fmt.Sprintf(format, args...))
+}
+
+func logWarning(format string, args ...interface{}) {
+	fsarkLogger.write(levelWarning, fmt.Sprintf(format, args...))
+}
+
+func logInfo(format string, args ...interface{}) {
+	fsarkLogger.write(levelInfo, fmt.Sprintf(format, args...))
+}
+
+func logDebug(format string, args ...interface{}) {
+	fsarkLogger.write(levelDebug, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	testcases := []struct {
+		Value    string
+		Expected logLevel
+		Error    bool
+	}{
+		{"error", levelError, false},
+		{"warn", levelWarning, false},
+		{"WARNING", levelWarning, false},
+		{" info ", levelInfo, false},
+		{"debug", levelDebug, false},
+		{"trace", levelError, true},
+		{"", levelError, true},
+	}
+	for _, testcase := range testcases {
+		level, err := parseLogLevel(testcase.Value)
+		if testcase.Error {
+			if err == nil {
+				t.Errorf("Expected error for %q, got level %v", testcase.Value, level)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Value, err)
+		} else if level != testcase.Expected {
+			t.Errorf("Expected level %v for %q, got %v", testcase.Expected, testcase.Value, level)
+		}
+	}
+}
+
+func testLogger(level logLevel, asJSON bool) (*logger, *bytes.Buffer) {
+	var buffer bytes.Buffer
+	return &logger{
+		out:    &buffer,
+		level:  level,
+		asJSON: asJSON,
+		now: func() time.Time {
+			return time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+		},
+	}, &buffer
+}
+
+func TestLoggerLevels(t *testing.T) {
+	l, buffer := testLogger(levelWarning, false)
+	l.write(levelError, "failed")
+	l.write(levelWarning, "careful\n")
+	l.write(levelInfo, "hello")
+	l.write(levelDebug, "details")
+
+	expected := "2023/04/05 06:07:08 error: failed\n2023/04/05 06:07:08 warn: careful\n"
+	if buffer.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buffer.String())
+	}
+
+	buffer.Reset()
+	l.setLevel(levelDebug)
+	l.write(levelDebug, "details")
+	if !strings.HasSuffix(buffer.String(), "debug: details\n") {
+		t.Errorf("Expected debug message once verbose, got %q", buffer.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, buffer := testLogger(levelInfo, true)
+	l.write(levelInfo, "Keeping container bundle in /tmp/bundle\n")
+	l.write(levelDebug, "details")
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one line, got %q", buffer.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Expected a line of JSON, got %q: %v", lines[0], err)
+	}
+	if entry["level"] != "info" || entry["msg"] != "Keeping container bundle in /tmp/bundle" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+	if entry["time"] != "2023-04-05T06:07:08Z" {
+		t.Errorf("Unexpected time in %v", entry)
+	}
+	if entry["pid"] != float64(os.Getpid()) {
+		t.Errorf("Expected pid %d in %v", os.Getpid(), entry)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	saved := fsarkLogger
+	defer func() { fsarkLogger = saved }()
+	fsarkLogger = &logger{out: os.Stderr, level: defaultLogLevel, now: time.Now}
+
+	path := filepath.Join(t.TempDir(), "fsark.log")
+	t.Setenv("FSARK_LOG_LEVEL", "debug")
+	t.Setenv("FSARK_LOG_FORMAT", "json")
+	t.Setenv("FSARK_LOG_FILE", path)
+	if err := configureLogging(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fsarkLogger.file.Close()
+	if fsarkLogger.level != levelDebug || !fsarkLogger.asJSON || !fsarkLogger.hasFile() {
+		t.Errorf("Expected debug JSON logging to a file, got %+v", fsarkLogger)
+	}
+	logDebug("Using %v", "runc")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"msg":"Using runc"`) {
+		t.Errorf("Expected message in log file, got %q", content)
+	}
+
+	t.Setenv("FSARK_LOG_LEVEL", "loud")
+	t.Setenv("FSARK_LOG_FORMAT", "xml")
+	t.Setenv("FSARK_LOG_FILE", "")
+	err = configureLogging()
+	if err == nil || !strings.Contains(err.Error(), "FSARK_LOG_LEVEL") || !strings.Contains(err.Error(), "FSARK_LOG_FORMAT") {
+		t.Errorf("Expected errors for both level and format, got %v", err)
+	}
+}
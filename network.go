@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Commands can be run with one of the following network modes:
+//
+//   - host: the container shares the host's network, which is the default
+//   - none: the container gets its own network namespace with only loopback
+//   - slirp: the container gets its own network namespace which is connected
+//     to the outside world by a user mode network stack, either pasta or
+//     slirp4netns, with optional port forwarding from the host
+//
+// For slirp the user mode network stack has to be attached to the container
+// after its network namespace exists, but before the command starts running.
+// To do that we add a createRuntime hook to the spec, which the runtime runs
+// on the host with the state of the container, and which is just fsark run
+// again with FSARK_HOOK set in its environment.
+
+const (
+	networkHost  = "host"
+	networkNone  = "none"
+	networkSlirp = "slirp"
+)
+
+const (
+	hookEnvironmentVariable = "FSARK_HOOK"
+	networkHookName         = "network"
+
+	networkConfigFilename = "network.json"
+	networkPIDFilename    = "network.pid"
+	networkLogFilename    = "network.log"
+
+	// slirp4netns always uses this address for its DNS forwarder
+	slirp4netnsDNS = "10.0.2.3"
+)
+
+var slirpBackends = []string{"pasta", "slirp4netns"}
+
+type portMapping struct {
+	HostAddress string `json:"host_address,omitempty"`
+	HostPort    int    `json:"host_port"`
+	GuestPort   int    `json:"guest_port"`
+	Protocol    string `json:"protocol"`
+}
+
+// networkConfig is what is passed from fsark to the network hook via a file
+// in the bundle directory
+type networkConfig struct {
+	Backend string        `json:"backend"`
+	Path    string        `json:"path"`
+	Ports   []portMapping `json:"ports,omitempty"`
+}
+
+type containerState struct {
+	ID     string `json:"id"`
+	PID    int    `json:"pid"`
+	Bundle string `json:"bundle"`
+}
+
+func validateNetworking(networking string, ports []string) error {
+	switch networking {
+	case "", networkHost, networkNone:
+		if len(ports) > 0 {
+			return fmt.Errorf("ports can only be used with %s networking", networkSlirp)
+		}
+	case networkSlirp:
+		for _, port := range ports {
+			if _, err := parsePortMapping(port); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown networking mode %q, expected one of %s, %s or %s", networking, networkHost, networkNone, networkSlirp)
+	}
+	return nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port number %q", value)
+	}
+	return port, nil
+}
+
+// parsePortMapping parses port forwards written as [address:]hostport:guestport[/protocol]
+func parsePortMapping(value string) (portMapping, error) {
+	mapping := portMapping{Protocol: "tcp"}
+
+	body := value
+	if index := strings.LastIndex(value, "/"); index != -1 {
+		body = value[:index]
+		mapping.Protocol = value[index+1:]
+		if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+			return portMapping{}, fmt.Errorf("invalid protocol in port mapping %q, expected tcp or udp", value)
+		}
+	}
+
+	parts := strings.Split(body, ":")
+	var err error
+	switch len(parts) {
+	case 2:
+	case 3:
+		if net.ParseIP(parts[0]) == nil {
+			return portMapping{}, fmt.Errorf("invalid address in port mapping %q", value)
+		}
+		mapping.HostAddress = parts[0]
+		parts = parts[1:]
+	default:
+		return portMapping{}, fmt.Errorf("invalid port mapping %q, expected [address:]hostport:guestport[/protocol]", value)
+	}
+	mapping.HostPort, err = parsePort(parts[0])
+	if err != nil {
+		return portMapping{}, fmt.Errorf("in port mapping %q: %w", value, err)
+	}
+	mapping.GuestPort, err = parsePort(parts[1])
+	if err != nil {
+		return portMapping{}, fmt.Errorf("in port mapping %q: %w", value, err)
+	}
+	return mapping, nil
+}
+
+func findSlirpBackend(preferred string) (string, string, error) {
+	candidates := slirpBackends
+	if preferred != "" {
+		candidates = []string{preferred}
+	}
+	for _, candidate := range candidates {
+		path, err := exec.LookPath(candidate)
+		if err == nil {
+			return candidate, path, nil
+		}
+	}
+	return "", "", fmt.Errorf("slirp networking needs one of %s on the path", strings.Join(candidates, " or "))
+}
+
+// prepareNetwork works out the network settings for the spec, and for slirp
+// networking leaves the instructions for the network hook in the bundle.
+func prepareNetwork(bundlePath string, networking string, ports []string, preferredBackend string) (NetworkSettings, error) {
+	switch networking {
+	case "", networkHost:
+		return NetworkSettings{ResolvConf: "/etc/resolv.conf"}, nil
+
+	case networkNone:
+		return NetworkSettings{Isolated: true}, nil
+
+	case networkSlirp:
+		backend, backendPath, err := findSlirpBackend(preferredBackend)
+		if err != nil {
+			return NetworkSettings{}, err
+		}
+		logDebug("Using %v at %v for networking", backend, backendPath)
+		config := networkConfig{
+			Backend: backend,
+			Path:    backendPath,
+		}
+		for _, port := range ports {
+			mapping, err := parsePortMapping(port)
+			if err != nil {
+				return NetworkSettings{}, err
+			}
+			config.Ports = append(config.Ports, mapping)
+		}
+		content, err := json.Marshal(config)
+		if err != nil {
+			return NetworkSettings{}, fmt.Errorf("failed to encode network config: %w", err)
+		}
+		err = os.WriteFile(filepath.Join(bundlePath, networkConfigFilename), content, 0644)
+		if err != nil {
+			return NetworkSettings{}, fmt.Errorf("failed to write network config: %w", err)
+		}
+
+		fsarkPath, err := os.Executable()
+		if err != nil {
+			return NetworkSettings{}, fmt.Errorf("failed to find fsark executable for network hook: %w", err)
+		}
+
+		resolvConf := "/etc/resolv.conf"
+		if backend == "slirp4netns" {
+			resolvConf = filepath.Join(bundlePath, "resolv.conf")
+			content := fmt.Sprintf("nameserver %s\n", slirp4netnsDNS)
+			err = os.WriteFile(resolvConf, []byte(content), 0644)
+			if err != nil {
+				return NetworkSettings{}, fmt.Errorf("failed to write resolv.conf: %w", err)
+			}
+		}
+
+		return NetworkSettings{
+			Isolated:   true,
+			ResolvConf: resolvConf,
+			CreateRuntimeHooks: []specs.Hook{
+				{
+					Path: fsarkPath,
+					Args: []string{fsarkPath},
+					Env:  []string{fmt.Sprintf("%s=%s", hookEnvironmentVariable, networkHookName)},
+				},
+			},
+		}, nil
+
+	default:
+		return NetworkSettings{}, fmt.Errorf("unknown networking mode %q", networking)
+	}
+}
+
+// stopNetwork stops any user mode network stack that the network hook left
+// running for the container in the given bundle.
+func stopNetwork(bundlePath string) {
+	content, err := os.ReadFile(filepath.Join(bundlePath, networkPIDFilename))
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// runNetworkHook is run by the runtime when the container's namespaces
+// exist, with the container state on stdin, and attaches the user mode
+// network stack to it.
+func runNetworkHook() error {
+	var state containerState
+	err := json.NewDecoder(os.Stdin).Decode(&state)
+	if err != nil {
+		return fmt.Errorf("failed to read container state: %w", err)
+	}
+	if state.PID <= 0 {
+		return fmt.Errorf("container state has no pid")
+	}
+
+	content, err := os.ReadFile(filepath.Join(state.Bundle, networkConfigFilename))
+	if err != nil {
+		return fmt.Errorf("failed to read network config: %w", err)
+	}
+	var config networkConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return fmt.Errorf("failed to parse network config: %w", err)
+	}
+
+	// The runtime waits for the hook's output to be closed, so the network
+	// stack that we leave running mustn't hold on to our stdout or stderr.
+	logFile, err := os.OpenFile(filepath.Join(state.Bundle, networkLogFilename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open network log: %w", err)
+	}
+	defer logFile.Close()
+
+	switch config.Backend {
+	case "pasta":
+		return startPasta(config, state, logFile)
+	case "slirp4netns":
+		return startSlirp4netns(config, state, logFile)
+	default:
+		return fmt.Errorf("unknown slirp backend %q", config.Backend)
+	}
+}
+
+func startPasta(config networkConfig, state containerState, logFile *os.File) error {
+	args := []string{
+		config.Path,
+		"--config-net",
+		"--quiet",
+		"--pid", filepath.Join(state.Bundle, networkPIDFilename),
+	}
+	for _, port := range config.Ports {
+		flag := "-t"
+		if port.Protocol == "udp" {
+			flag = "-u"
+		}
+		spec := fmt.Sprintf("%d:%d", port.HostPort, port.GuestPort)
+		if port.HostAddress != "" {
+			spec = fmt.Sprintf("%s/%s", port.HostAddress, spec)
+		}
+		args = append(args, flag, spec)
+	}
+	args = append(args, strconv.Itoa(state.PID))
+
+	// pasta runs in the background itself once the network is configured
+	cmd := &exec.Cmd{
+		Path:   config.Path,
+		Args:   args,
+		Stdout: logFile,
+		Stderr: logFile,
+	}
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("pasta failed, see %s: %w", logFile.Name(), err)
+	}
+	return nil
+}
+
+func startSlirp4netns(config networkConfig, state containerState, logFile *os.File) error {
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe for slirp4netns: %w", err)
+	}
+	defer readyReader.Close()
+
+	apiSocket := filepath.Join(state.Bundle, "slirp4netns.sock")
+	cmd := &exec.Cmd{
+		Path: config.Path,
+		Args: []string{
+			config.Path,
+			"--configure",
+			"--mtu=65520",
+			"--disable-host-loopback",
+			"--ready-fd=3",
+			"--api-socket", apiSocket,
+			strconv.Itoa(state.PID),
+			"tap0",
+		},
+		Stdout:      logFile,
+		Stderr:      logFile,
+		ExtraFiles:  []*os.File{readyWriter},
+		SysProcAttr: &syscall.SysProcAttr{Setsid: true},
+	}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start slirp4netns: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(state.Bundle, networkPIDFilename), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("failed to record slirp4netns pid: %w", err)
+	}
+
+	ready := make([]byte, 1)
+	if _, err := readyReader.Read(ready); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("slirp4netns failed to start, see %s: %w", logFile.Name(), err)
+	}
+
+	for _, port := range config.Ports {
+		err := addSlirp4netnsPortForward(apiSocket, port)
+		if err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+	}
+
+	return cmd.Process.Release()
+}
+
+func addSlirp4netnsPortForward(apiSocket string, port portMapping) error {
+	conn, err := net.Dial("unix", apiSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to slirp4netns: %w", err)
+	}
+	defer conn.Close()
+
+	hostAddress := port.HostAddress
+	if hostAddress == "" {
+		hostAddress = "0.0.0.0"
+	}
+	request := map[string]interface{}{
+		"execute": "add_hostfwd",
+		"arguments": map[string]interface{}{
+			"proto":      port.Protocol,
+			"host_addr":  hostAddress,
+			"host_port":  port.HostPort,
+			"guest_port": port.GuestPort,
+		},
+	}
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return fmt.Errorf("failed to send port forward to slirp4netns: %w", err)
+	}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		unixConn.CloseWrite()
+	}
+
+	var response struct {
+		Error *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("failed to read port forward response from slirp4netns: %w", err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("slirp4netns failed to forward port %d: %s", port.HostPort, response.Error.Desc)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestParsePortMapping(t *testing.T) {
+	testcases := []struct {
+		Value    string
+		Expected portMapping
+	}{
+		{"8080:80", portMapping{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}},
+		{"5353:53/udp", portMapping{HostPort: 5353, GuestPort: 53, Protocol: "udp"}},
+		{"127.0.0.1:8080:80/tcp", portMapping{HostAddress: "127.0.0.1", HostPort: 8080, GuestPort: 80, Protocol: "tcp"}},
+	}
+	for _, testcase := range testcases {
+		mapping, err := parsePortMapping(testcase.Value)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", testcase.Value, err)
+			continue
+		}
+		if mapping != testcase.Expected {
+			t.Errorf("Expected %v, got %v", testcase.Expected, mapping)
+		}
+	}
+
+	invalid := []string{"80", "8080:80/sctp", "0:80", "8080:70000", "notanip:8080:80", "a:b"}
+	for _, value := range invalid {
+		if _, err := parsePortMapping(value); err == nil {
+			t.Errorf("Expected error parsing %q", value)
+		}
+	}
+}
+
+func TestValidateNetworking(t *testing.T) {
+	valid := []struct {
+		Networking string
+		Ports      []string
+	}{
+		{"", nil},
+		{"host", nil},
+		{"none", nil},
+		{"slirp", []string{"8080:80"}},
+	}
+	for _, testcase := range valid {
+		if err := validateNetworking(testcase.Networking, testcase.Ports); err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Networking, err)
+		}
+	}
+
+	if err := validateNetworking("bridge", nil); err == nil {
+		t.Errorf("Expected error for unknown networking mode")
+	}
+	if err := validateNetworking("none", []string{"8080:80"}); err == nil {
+		t.Errorf("Expected error for ports without slirp networking")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProvenanceConfig enables writing a record of each invocation of a command,
+// either as a file per run in Directory, or appended as a line of JSON to Log,
+// or both. If neither is set then records are written to the provenance
+// directory in the fsark state directory.
+type ProvenanceConfig struct {
+	Directory string `json:"directory,omitempty"`
+	Log       string `json:"log,omitempty"`
+}
+
+type provenanceRecord struct {
+	ID                string            `json:"id"`
+	Command           string            `json:"command"`
+	Args              []string          `json:"args"`
+	Image             string            `json:"image"`
+	ImageReference    string            `json:"image_reference"`
+	ImageDigest       string            `json:"image_digest,omitempty"`
+	ConfigPath        string            `json:"config_path"`
+	ConfigHash        string            `json:"config_hash"`
+	Cwd               string            `json:"cwd"`
+	EnvironmentKeys   []string          `json:"environment_keys"`
+	EnvironmentHashes map[string]string `json:"environment_hashes,omitempty"`
+	EnvironmentSalt   string            `json:"environment_salt,omitempty"`
+	Mounts            []BindMount       `json:"mounts"`
+	Host              string            `json:"host"`
+	User              string            `json:"user"`
+	Start             time.Time         `json:"start"`
+	End               time.Time         `json:"end"`
+	ExitCode          int               `json:"exit_code"`
+	BuildInfo         map[string]string `json:"build_info,omitempty"`
+	Files             *fileChanges      `json:"files,omitempty"`
+	ReplayOf          string            `json:"replay_of,omitempty"`
+}
+
+func configHash(configData []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(configData))
+}
+
+// buildInfo returns the details of how fsark was built, keyed by the name of
+// the environment variable that they are passed to the container in.
+func buildInfo() map[string]string {
+	settings := make(map[string]string)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings["FSARK_PATH"] = info.Main.Path
+		settings["FSARK_VERSION"] = info.Main.Version
+		for _, setting := range info.Settings {
+			settings[fmt.Sprintf("FSARK_%s", strings.ReplaceAll(strings.ToUpper(setting.Key), ".", "_"))] = setting.Value
+		}
+	}
+	return settings
+}
+
+func environmentKeys(env []string) []string {
+	keys := make([]string, 0, len(env))
+	for _, item := range env {
+		keys = append(keys, strings.SplitN(item, "=", 2)[0])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// environmentHashes hashes the value of each environment variable, so that a
+// replay can tell which have changed without the record giving away their
+// values, which may well be secret. The hashes are keyed with a salt that is
+// kept secret in the state directory, so that a value can't be found by
+// hashing likely values, but that only holds as long as the salt does, and
+// a replay by another user can't check them.
+func environmentHashes(salt []byte, env []string) map[string]string {
+	hashes := make(map[string]string, len(env))
+	for _, item := range env {
+		key := strings.SplitN(item, "=", 2)[0]
+		mac := hmac.New(sha256.New, salt)
+		mac.Write([]byte(item))
+		hashes[key] = fmt.Sprintf("hmac-sha256:%x", mac.Sum(nil))
+	}
+	return hashes
+}
+
+// saltID identifies a salt in a record, without giving it away, so that a
+// replay can tell whether it's able to check the hashes made with it.
+func saltID(salt []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(salt))
+}
+
+type provenanceLocations struct {
+	directory string
+	log       string
+}
+
+func resolveProvenanceLocations(conf Config, variables expansionVariables) (provenanceLocations, error) {
+	if conf.Provenance == nil {
+		return provenanceLocations{}, nil
+	}
+	var locations provenanceLocations
+	var err error
+	if conf.Provenance.Directory != "" {
+		locations.directory, err = variables.expand(conf.Provenance.Directory)
+		if err != nil {
+			return provenanceLocations{}, fmt.Errorf("provenance directory: %w", err)
+		}
+	}
+	if conf.Provenance.Log != "" {
+		locations.log, err = variables.expand(conf.Provenance.Log)
+		if err != nil {
+			return provenanceLocations{}, fmt.Errorf("provenance log: %w", err)
+		}
+	}
+	if locations.directory == "" && locations.log == "" {
+		stateDir, err := stateDirectory(conf, variables)
+		if err != nil {
+			return provenanceLocations{}, err
+		}
+		locations.directory = filepath.Join(stateDir, "provenance")
+	}
+	return locations, nil
+}
+
+func (l provenanceLocations) enabled() bool {
+	return l.directory != "" || l.log != ""
+}
+
+func (l provenanceLocations) write(record provenanceRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance record: %w", err)
+	}
+
+	if l.directory != "" {
+		err = os.MkdirAll(l.directory, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create provenance directory: %w", err)
+		}
+		recordPath := filepath.Join(l.directory, fmt.Sprintf("%s.json", record.ID))
+		err = os.WriteFile(recordPath, content, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write provenance record: %w", err)
+		}
+	}
+
+	if l.log != "" {
+		err = os.MkdirAll(filepath.Dir(l.log), 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create provenance log directory: %w", err)
+		}
+		// Write the record as a single line in a single write, so that
+		// concurrent runs appending to the same log don't interleave
+		logFile, err := os.OpenFile(l.log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open provenance log: %w", err)
+		}
+		_, err = logFile.Write(append(content, '\n'))
+		if err != nil {
+			logFile.Close()
+			return fmt.Errorf("failed to append to provenance log: %w", err)
+		}
+		err = logFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close provenance log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readAll returns all the provenance records, oldest first.
+func (l provenanceLocations) readAll() ([]provenanceRecord, error) {
+	records := make(map[string]provenanceRecord)
+
+	if l.directory != "" {
+		entries, err := os.ReadDir(l.directory)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read provenance directory: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(l.directory, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read provenance record: %w", err)
+			}
+			var record provenanceRecord
+			err = json.Unmarshal(content, &record)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse provenance record %v: %w", entry.Name(), err)
+			}
+			records[record.ID] = record
+		}
+	}
+
+	if l.log != "" {
+		logFile, err := os.Open(l.log)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to open provenance log: %w", err)
+		}
+		if err == nil {
+			defer logFile.Close()
+			scanner := bufio.NewScanner(logFile)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			line := 0
+			for scanner.Scan() {
+				line += 1
+				if len(strings.TrimSpace(scanner.Text())) == 0 {
+					continue
+				}
+				var record provenanceRecord
+				err = json.Unmarshal(scanner.Bytes(), &record)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse provenance log line %d: %w", line, err)
+				}
+				records[record.ID] = record
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read provenance log: %w", err)
+			}
+		}
+	}
+
+	result := make([]provenanceRecord, 0, len(records))
+	for _, record := range records {
+		result = append(result, record)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result, nil
+}
+
+// find returns the record with the given run ID, which may be abbreviated
+// as long as it is unambiguous.
+func (l provenanceLocations) find(id string) (provenanceRecord, error) {
+	records, err := l.readAll()
+	if err != nil {
+		return provenanceRecord{}, err
+	}
+	var matches []provenanceRecord
+	for _, record := range records {
+		if record.ID == id {
+			return record, nil
+		}
+		if strings.HasPrefix(record.ID, id) {
+			matches = append(matches, record)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return provenanceRecord{}, fmt.Errorf("no run with id %v", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return provenanceRecord{}, fmt.Errorf("run id %v is ambiguous, it matches %d runs", id, len(matches))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProvenanceRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	locations := provenanceLocations{
+		directory: filepath.Join(dir, "records"),
+		log:       filepath.Join(dir, "logs", "provenance.log"),
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []provenanceRecord{
+		{ID: "bbbb2222", Command: "mypython3", Start: start.Add(time.Hour), ExitCode: 1},
+		{ID: "aaaa1111", Command: "mysh", Start: start, ExitCode: 0},
+		{ID: "aaab3333", Command: "mysh", Start: start.Add(2 * time.Hour), ExitCode: 0},
+	}
+	for _, record := range records {
+		if err := locations.write(record); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	// both locations hold all records, but they should only be listed once
+	found, err := locations.readAll()
+	if err != nil {
+		t.Fatalf("Failed to read records: %v", err)
+	}
+	expectedOrder := []string{"aaaa1111", "bbbb2222", "aaab3333"}
+	if len(found) != len(expectedOrder) {
+		t.Fatalf("Expected %d records, got %d", len(expectedOrder), len(found))
+	}
+	for index, id := range expectedOrder {
+		if found[index].ID != id {
+			t.Errorf("Expected record %d to be %s, got %s", index, id, found[index].ID)
+		}
+	}
+
+	record, err := locations.find("bbbb")
+	if err != nil {
+		t.Errorf("Unexpected error finding record by prefix: %v", err)
+	} else if record.Command != "mypython3" {
+		t.Errorf("Expected mypython3, got %s", record.Command)
+	}
+	if _, err := locations.find("aaa"); err == nil {
+		t.Errorf("Expected error for ambiguous prefix")
+	}
+	if _, err := locations.find("cccc"); err == nil {
+		t.Errorf("Expected error for missing record")
+	}
+}
+
+func TestEnvironmentHashes(t *testing.T) {
+	stateDir := t.TempDir()
+	conf := Config{StateDirectory: stateDir}
+	variables := expansionVariables{fsark: map[string]string{"HOME": "/home/alice", "USER": "alice"}}
+
+	salt, err := environmentSalt(conf, variables)
+	if err != nil {
+		t.Fatalf("Failed to create salt: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(stateDir, environmentSaltName))
+	if err != nil {
+		t.Fatalf("Expected salt to be saved: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected salt to only be readable by its owner, got %v", info.Mode())
+	}
+	again, err := environmentSalt(conf, variables)
+	if err != nil || !bytes.Equal(salt, again) {
+		t.Errorf("Expected the same salt again, got %x, %v", again, err)
+	}
+
+	env := []string{"TOKEN=x", "LANG=C"}
+	hashes := environmentHashes(salt, env)
+	if hashes["TOKEN"] == environmentHashes(salt, []string{"TOKEN=y"})["TOKEN"] {
+		t.Errorf("Expected different values to have different hashes")
+	}
+	if hashes["TOKEN"] == environmentHashes([]byte("other"), env)["TOKEN"] {
+		t.Errorf("Expected the hash to depend on the salt")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Replaying a run takes the command, arguments, working directory and image
+// digest from its provenance record, and everything else from the current
+// config. Anything that differs from the original run, and so might make the
+// replay behave differently, is reported as a warning.
+
+func runReplay(ctx subcommandContext, args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay <run id>\n", fsarkName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	locations, err := resolveProvenanceLocations(ctx.conf, ctx.variables)
+	if err != nil {
+		logError("Failed to find provenance records: %v", err)
+		return 1
+	}
+	if !locations.enabled() {
+		logError("Provenance records are not enabled in the config")
+		return 1
+	}
+	record, err := locations.find(flags.Arg(0))
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	commandConfig, ok := ctx.conf.Commands[record.Command]
+	if !ok {
+		logError("Cannot replay run %v: command %v is no longer in the config", record.ID, record.Command)
+		return 1
+	}
+	if record.ConfigHash != configHash(ctx.configData) {
+		logWarning("The config has changed since run %v", record.ID)
+	}
+	info, err := os.Stat(record.Cwd)
+	if err != nil || !info.IsDir() {
+		logError("Cannot replay run %v: working directory %v is no longer available", record.ID, record.Cwd)
+		return 1
+	}
+
+	return runCommand(invocation{
+		conf:          ctx.conf,
+		configData:    ctx.configData,
+		name:          record.Command,
+		commandConfig: commandConfig,
+		cwd:           record.Cwd,
+		variables:     newExpansionVariables(record.Command, record.Cwd, ctx.conf.StrictExpansion),
+		signals:       ctx.signals,
+		replay:        &record,
+	})
+}
+
+// pinReplayImage makes the image refer to exactly the image used in the
+// recorded run. For images from a registry this means fetching by digest
+// rather than by tag. Local image archives can't be pinned, so we just check
+// they've not changed.
+func pinReplayImage(image Image, record provenanceRecord, cacheDir string) (Image, []string, error) {
+	var warnings []string
+	if record.ImageDigest == "" {
+		return Image{}, nil, fmt.Errorf("the record has no image digest")
+	}
+	if image.ImageRootFSPath != record.ImageReference {
+		warnings = append(warnings, fmt.Sprintf("image %v now refers to %v, replaying with %v", record.Image, image.ImageRootFSPath, record.ImageReference))
+	}
+
+	pinned := image
+	if _, err := os.Stat(record.ImageReference); err == nil {
+		digest, err := imageDigest(record.ImageReference, record.ImageReference, cacheDir)
+		if err != nil {
+			return Image{}, nil, fmt.Errorf("failed to check image %v: %w", record.ImageReference, err)
+		}
+		if digest != record.ImageDigest {
+			warnings = append(warnings, fmt.Sprintf("image %v has changed since the run, it was %v and is now %v", record.ImageReference, record.ImageDigest, digest))
+		}
+		pinned.ImageRootFSPath = record.ImageReference
+		return pinned, warnings, nil
+	}
+
+	ref, err := name.ParseReference(record.ImageReference, name.Insecure)
+	if err != nil {
+		return Image{}, nil, fmt.Errorf("image %v is neither a local file nor a valid image reference: %w", record.ImageReference, err)
+	}
+	pinned.ImageRootFSPath = ref.Context().Digest(record.ImageDigest).String()
+	return pinned, warnings, nil
+}
+
+func mountsByDestination(mounts []BindMount) map[string]BindMount {
+	result := make(map[string]BindMount, len(mounts))
+	for _, mount := range mounts {
+		result[mount.Destination] = mount
+	}
+	return result
+}
+
+// compareReplay lists the ways in which the container built for a replay,
+// and run by user, differs from the one in the recorded run. The values of
+// environment variables are only checked if salt is the one the run hashed
+// them with.
+func compareReplay(record provenanceRecord, container builtContainer, user string, salt []byte) []string {
+	var warnings []string
+
+	if record.User != "" && record.User != user {
+		warnings = append(warnings, fmt.Sprintf("the run was by %v, replaying as %v", record.User, user))
+	}
+
+	// Variables set by fsark itself, such as the run ID, are expected to
+	// differ, so we only compare those from the config and host.
+	recordedKeys := make(map[string]bool)
+	for _, key := range record.EnvironmentKeys {
+		if !strings.HasPrefix(key, "FSARK") {
+			recordedKeys[key] = true
+		}
+	}
+	currentKeys := make(map[string]bool)
+	for _, key := range environmentKeys(container.Spec.Process.Env) {
+		if !strings.HasPrefix(key, "FSARK") {
+			currentKeys[key] = true
+		}
+	}
+	var missing, added []string
+	for key := range recordedKeys {
+		if !currentKeys[key] {
+			missing = append(missing, key)
+		}
+	}
+	for key := range currentKeys {
+		if !recordedKeys[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(added)
+	if len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("environment variables from the run are not set: %s", strings.Join(missing, ", ")))
+	}
+	if len(added) > 0 {
+		warnings = append(warnings, fmt.Sprintf("environment variables not in the run are set: %s", strings.Join(added, ", ")))
+	}
+
+	// Only hashes of the values are recorded, so we can say which have
+	// changed but not replay with the old ones. Older records don't have
+	// them at all.
+	if record.EnvironmentHashes == nil {
+		if len(recordedKeys) > 0 {
+			warnings = append(warnings, "the run didn't record environment variable values, so they can't be checked")
+		}
+	} else if salt == nil || record.EnvironmentSalt != saltID(salt) {
+		warnings = append(warnings, "the run hashed environment variable values with a different salt, such as another user's, so they can't be checked")
+	} else {
+		currentHashes := environmentHashes(salt, container.Spec.Process.Env)
+		var changed []string
+		for key := range recordedKeys {
+			if recorded, ok := record.EnvironmentHashes[key]; ok && currentKeys[key] && currentHashes[key] != recorded {
+				changed = append(changed, key)
+			}
+		}
+		sort.Strings(changed)
+		for _, key := range changed {
+			warnings = append(warnings, fmt.Sprintf("environment variable %v has a different value from the run", key))
+		}
+	}
+
+	recordedMounts := mountsByDestination(record.Mounts)
+	currentMounts := mountsByDestination(container.Mounts)
+	destinations := make([]string, 0, len(recordedMounts))
+	for destination := range recordedMounts {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+	for _, destination := range destinations {
+		recorded := recordedMounts[destination]
+		current, ok := currentMounts[destination]
+		switch {
+		case !ok:
+			warnings = append(warnings, fmt.Sprintf("mount %v from the run is missing", destination))
+		case strings.HasPrefix(destination, secretsMountPath+"/"):
+			// secrets are staged to a different place on each run
+		case current.Source != recorded.Source:
+			warnings = append(warnings, fmt.Sprintf("mount %v was from %v but is now from %v", destination, recorded.Source, current.Source))
+		case current.ReadOnly != recorded.ReadOnly:
+			warnings = append(warnings, fmt.Sprintf("mount %v has changed whether it is read only", destination))
+		}
+	}
+	for destination := range currentMounts {
+		if _, ok := recordedMounts[destination]; !ok {
+			warnings = append(warnings, fmt.Sprintf("mount %v was not in the run", destination))
+		}
+	}
+
+	current := buildInfo()
+	for _, key := range []string{"FSARK_VERSION", "FSARK_VCS_REVISION"} {
+		if record.BuildInfo[key] != current[key] {
+			warnings = append(warnings, fmt.Sprintf("fsark has changed since the run, %s was %q and is now %q", key, record.BuildInfo[key], current[key]))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestPinReplayImageFromRegistry(t *testing.T) {
+	digest := "sha256:8c0e80291942fb3a7da0fd26615468f5458f973538ba5e9a9f566c36da0159d0"
+	record := provenanceRecord{
+		Image:          "python",
+		ImageReference: "ghcr.io/quantifyearth/python:3.12",
+		ImageDigest:    digest,
+	}
+
+	pinned, warnings, err := pinReplayImage(Image{ImageRootFSPath: "ghcr.io/quantifyearth/python:3.12"}, record, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "ghcr.io/quantifyearth/python@" + digest
+	if pinned.ImageRootFSPath != expected {
+		t.Errorf("Expected %v, got %v", expected, pinned.ImageRootFSPath)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+
+	_, warnings, err = pinReplayImage(Image{ImageRootFSPath: "ghcr.io/quantifyearth/python:3.13"}, record, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected a warning about the changed image, got %v", warnings)
+	}
+
+	if _, _, err := pinReplayImage(Image{}, provenanceRecord{ImageReference: "python:3.12"}, ""); err == nil {
+		t.Errorf("Expected error for record without digest")
+	}
+}
+
+func TestCompareReplay(t *testing.T) {
+	salt := []byte("salt")
+	record := provenanceRecord{
+		ID:                "aaaa1111",
+		User:              "alice",
+		EnvironmentKeys:   []string{"FSARK_RUN_ID", "LANG", "PATH", "TOKEN"},
+		EnvironmentHashes: environmentHashes(salt, []string{"PATH=/bin", "LANG=C", "TOKEN=x", "FSARK_RUN_ID=aaaa1111"}),
+		EnvironmentSalt:   saltID(salt),
+		Mounts: []BindMount{
+			{Source: "/home/alice/project", Destination: "/ark"},
+			{Source: "/scratch", Destination: "/scratch"},
+			{Source: "/run/user/1000/fsark-secrets-1/key", Destination: "/run/secrets/key", ReadOnly: true},
+		},
+		BuildInfo: buildInfo(),
+	}
+
+	same := builtContainer{
+		Spec: specs.Spec{Process: &specs.Process{Env: []string{"PATH=/bin", "LANG=C", "TOKEN=x", "FSARK_RUN_ID=other"}}},
+		Mounts: []BindMount{
+			{Source: "/home/alice/project", Destination: "/ark"},
+			{Source: "/scratch", Destination: "/scratch"},
+			{Source: "/run/user/1000/fsark-secrets-2/key", Destination: "/run/secrets/key", ReadOnly: true},
+		},
+	}
+	if warnings := compareReplay(record, same, "alice", salt); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", warnings)
+	}
+
+	different := builtContainer{
+		Spec: specs.Spec{Process: &specs.Process{Env: []string{"PATH=/usr/bin", "LANG=C", "EXTRA=1"}}},
+		Mounts: []BindMount{
+			{Source: "/home/alice/other", Destination: "/ark"},
+			{Source: "/data", Destination: "/data"},
+			{Source: "/run/user/1000/fsark-secrets-2/key", Destination: "/run/secrets/key", ReadOnly: true},
+		},
+	}
+	warnings := compareReplay(record, different, "bob", salt)
+	expected := []string{"TOKEN", "EXTRA", "PATH", "bob", "/ark", "/scratch", "/data"}
+	for _, fragment := range expected {
+		found := false
+		for _, warning := range warnings {
+			found = found || strings.Contains(warning, fragment)
+		}
+		if !found {
+			t.Errorf("Expected a warning mentioning %v, got %v", fragment, warnings)
+		}
+	}
+	for _, warning := range warnings {
+		if strings.Contains(warning, "LANG") {
+			t.Errorf("Expected no warning about an unchanged variable, got %v", warning)
+		}
+	}
+
+	warnings = compareReplay(record, same, "alice", []byte("another"))
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "salt") {
+		t.Errorf("Expected a warning that values can't be checked with another salt, got %v", warnings)
+	}
+
+	record.EnvironmentHashes = nil
+	warnings = compareReplay(record, same, "alice", salt)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "values") {
+		t.Errorf("Expected a warning that values can't be checked, got %v", warnings)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const defaultKillGracePeriod = 10 * time.Second
+
+// timeoutExitCode is what we exit with if the command runs for longer than
+// its timeout, which matches what coreutils' timeout uses.
+const timeoutExitCode = 124
+
+// These are the signals that we catch and pass on to the container, rather
+// than letting them kill fsark and leave the container running without us.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+func isTerminatingSignal(sig os.Signal) bool {
+	switch sig {
+	case syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r ociRuntime) killContainer(id string, sig syscall.Signal) error {
+	cmd := r.command("kill", id, strconv.Itoa(int(sig)))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s kill failed: %w: %s", r.name, err, output)
+	}
+	return nil
+}
+
+// deleteContainer makes sure the runtime has no state left for the
+// container. Normally the runtime will have done this itself when the
+// container exits, so we expect this to fail most of the time and ignore the
+// result.
+func (r ociRuntime) deleteContainer(id string) {
+	cmd := r.command("delete", "--force", id)
+	cmd.Run()
+}
+
+// separateRuntime gives the runtime, run by cmd, a process group of its own,
+// so that signals sent to our whole group, such as by timeout(1), a shell's
+// job control or a service manager, reach the container once through us
+// rather than a second time through the runtime. The exception is when the
+// runtime reads from our terminal, as it has to stay in our foreground group
+// to do so. Then a signal sent to the group reaches the container twice,
+// which init takes care of, as we can't tell it apart from one sent to us
+// alone that we mustn't drop.
+func separateRuntime(cmd *exec.Cmd, terminal bool) {
+	if !terminal && isTerminal(os.Stdin) {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func consoleSocketPath(bundlePath string) string {
+	return filepath.Join(bundlePath, "console.sock")
+}
+
+// runArgs returns the arguments to the runtime to run the container in the
+// given bundle in the foreground.
+func runArgs(bundlePath string, id string, terminal bool) []string {
+	args := []string{"run", "-b", bundlePath}
+	if terminal {
+		args = append(args, "--console-socket", consoleSocketPath(bundlePath))
+	}
+	return append(args, id)
+}
+
+func exitCodeFromError(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if procError, ok := err.(*exec.ExitError); ok {
+		// If the runtime itself was killed by a signal then report that like a
+		// shell would, otherwise just pass on the exit code of the container.
+		if status, ok := procError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return procError.ExitCode(), nil
+	}
+	return 1, fmt.Errorf("failed to wait: %w", err)
+}
+
+// runContainer runs the container in the bundle at bundlePath to completion
+// and returns the exit code of the process within it. If terminal is set the
+// container is given a pseudo terminal that we proxy to our own, otherwise
+// our stdio file descriptors are passed directly through the runtime to the
+// container, so that output is binary safe and stderr stays separate.
+//
+// Signals arriving on the signals channel are forwarded to the container with
+// the runtime's kill command, and if a terminating signal doesn't cause the
+// container to exit within gracePeriod it is sent SIGKILL. Similarly, if
+// timeout is not zero and the container runs for longer than that, it is sent
+// SIGTERM, followed by SIGKILL if needed, and we return timeoutExitCode.
+//
+// If started is not nil it is called once the runtime has started the
+// container, as told by the started hook, which the spec must have.
+func runContainer(
+	runtime ociRuntime,
+	bundlePath string,
+	id string,
+	terminal bool,
+	signals <-chan os.Signal,
+	gracePeriod time.Duration,
+	timeout time.Duration,
+	started func(),
+) (int, error) {
+	defer runtime.deleteContainer(id)
+
+	// If we were asked to stop whilst we were preparing the container then
+	// don't bother starting it.
+	select {
+	case sig := <-signals:
+		if isTerminatingSignal(sig) {
+			return 128 + int(sig.(syscall.Signal)), nil
+		}
+	default:
+	}
+
+	var listener *net.UnixListener
+	if terminal {
+		var err error
+		listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: consoleSocketPath(bundlePath), Net: "unix"})
+		if err != nil {
+			return 1, fmt.Errorf("failed to create console socket: %w", err)
+		}
+		defer listener.Close()
+	}
+
+	cmd := runtime.command(runArgs(bundlePath, id, terminal)...)
+	cmd.Stderr = os.Stderr
+	if !terminal {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+	}
+
+	separateRuntime(cmd, terminal)
+
+	logDebug("Running container %v with %v in %v", id, runtime.name, bundlePath)
+	err := cmd.Start()
+	if err != nil {
+		return 1, fmt.Errorf("failed to run %s: %w", runtime.name, err)
+	}
+
+	waitResult := make(chan error, 1)
+	go func() {
+		waitResult <- cmd.Wait()
+	}()
+
+	type consoleResult struct {
+		console *os.File
+		err     error
+	}
+	consoleReady := make(chan consoleResult, 1)
+	proxyDone := make(chan error, 1)
+	proxying := false
+	if terminal {
+		go func() {
+			console, err := receiveConsole(listener)
+			consoleReady <- consoleResult{console, err}
+		}()
+	}
+
+	var timeoutTimer <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutTimer = timer.C
+	}
+	timedOut := false
+
+	// The hook can't tell us directly, so we look for what it leaves in
+	// the bundle, and look once more when the runtime exits in case the
+	// container was quicker than us.
+	var startedPoll <-chan time.Time
+	if started != nil {
+		ticker := time.NewTicker(containerPollInterval)
+		defer ticker.Stop()
+		startedPoll = ticker.C
+	}
+	checkStarted := func() {
+		if startedPoll != nil && containerStarted(bundlePath) {
+			startedPoll = nil
+			started()
+		}
+	}
+
+	var killTimer <-chan time.Time
+	for {
+		select {
+		case <-startedPoll:
+			checkStarted()
+
+		case result := <-consoleReady:
+			if result.err != nil {
+				cmd.Process.Kill()
+				<-waitResult
+				return 1, result.err
+			}
+			proxying = true
+			go func() {
+				proxyDone <- proxyConsole(result.console)
+				result.console.Close()
+			}()
+
+		case sig := <-signals:
+			logDebug("Forwarding %v to container %v", sig, id)
+			if err := runtime.killContainer(id, sig.(syscall.Signal)); err != nil {
+				logWarning("Failed to forward %v to container: %v", sig, err)
+			}
+			if isTerminatingSignal(sig) && killTimer == nil {
+				killTimer = time.After(gracePeriod)
+			}
+
+		case <-timeoutTimer:
+			logError("Command exceeded its timeout of %v, stopping it", timeout)
+			timedOut = true
+			if err := runtime.killContainer(id, syscall.SIGTERM); err != nil {
+				logError("Failed to stop container: %v", err)
+			}
+			if killTimer == nil {
+				killTimer = time.After(gracePeriod)
+			}
+
+		case <-killTimer:
+			logWarning("Container did not exit within %v, killing it", gracePeriod)
+			if err := runtime.killContainer(id, syscall.SIGKILL); err != nil {
+				logError("Failed to kill container: %v", err)
+			}
+
+		case err := <-waitResult:
+			checkStarted()
+			// If the runtime exited without ever giving us the console it
+			// most likely failed to create the container, in which case it
+			// will have said why on stderr. Otherwise we wait for the proxy
+			// to drain any remaining output.
+			if proxying {
+				if proxyErr := <-proxyDone; proxyErr != nil {
+					logError("Console error: %v", proxyErr)
+				}
+			}
+			if timedOut {
+				return timeoutExitCode, nil
+			}
+			code, err := exitCodeFromError(err)
+			logDebug("Container %v exited with code %d", id, code)
+			return code, err
+		}
+	}
+}
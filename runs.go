@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every run is recorded in the runs directory of the state directory whilst
+// it's in progress, with the fsark process holding a lock on its record for
+// as long as it lives. If fsark is killed before it can clean up, such as by
+// the OOM killer, the lock goes with it, and the next fsark to start finds
+// the record and removes what was left behind: the runtime's state for the
+// container, the network helper, the secrets and the bundle.
+
+const runsDirectoryName = "runs"
+
+type runRecord struct {
+	ID         string        `json:"id"`
+	RunID      string        `json:"run_id"`
+	Command    string        `json:"command"`
+	Bundle     string        `json:"bundle"`
+	KeepBundle bool          `json:"keep_bundle,omitempty"`
+	PID        int           `json:"pid"`
+	Started    time.Time     `json:"started"`
+	Runtime    runtimeRecord `json:"runtime"`
+}
+
+// activeRun is the record of our own run, and the lock we hold on it.
+type activeRun struct {
+	path string
+	file *os.File
+}
+
+// recordRun writes the record for a run and locks it. The record is written
+// and locked under a temporary name before being renamed into place, so that
+// anyone looking for abandoned runs never sees it unlocked.
+func recordRun(runsDir string, record runRecord) (*activeRun, error) {
+	content, err := json.MarshalIndent(record, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode run record: %w", err)
+	}
+	file, err := os.CreateTemp(runsDir, ".run-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create run record: %w", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		_, err = file.Write(content)
+	}
+	path := filepath.Join(runsDir, record.ID+".json")
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to write run record: %w", err)
+	}
+	return &activeRun{path: path, file: file}, nil
+}
+
+// release removes the record once the run has been cleaned up after.
+func (r *activeRun) release() {
+	os.Remove(r.path)
+	r.file.Close()
+}
+
+// abandonedRun is a run whose fsark has gone. We hold the lock on its record
+// whilst cleaning up, so that no one else tries to at the same time.
+type abandonedRun struct {
+	record runRecord
+	active activeRun
+}
+
+// findAbandonedRuns returns the runs whose records aren't locked. Records
+// we can't make sense of are left alone.
+func findAbandonedRuns(runsDir string) ([]abandonedRun, error) {
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read runs: %w", err)
+	}
+	var runs []abandonedRun
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(runsDir, entry.Name())
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			// still running
+			file.Close()
+			continue
+		}
+		var record runRecord
+		err = json.NewDecoder(file).Decode(&record)
+		if err != nil {
+			logWarning("Ignoring run record %v: %v", path, err)
+			file.Close()
+			continue
+		}
+		runs = append(runs, abandonedRun{record: record, active: activeRun{path: path, file: file}})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].record.Started.Before(runs[j].record.Started)
+	})
+	return runs, nil
+}
+
+// listActiveRuns returns the runs whose records are locked, as their fsark
+// is still running them.
+func listActiveRuns(runsDir string) ([]runRecord, error) {
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read runs: %w", err)
+	}
+	var runs []runRecord
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		file, err := os.Open(filepath.Join(runsDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			// abandoned, or gone
+			file.Close()
+			continue
+		}
+		var record runRecord
+		err = json.NewDecoder(file).Decode(&record)
+		file.Close()
+		if err != nil {
+			continue
+		}
+		runs = append(runs, record)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Started.Before(runs[j].Started)
+	})
+	return runs, nil
+}
+
+// findActiveRun looks up a run in progress by its run ID or container ID, a
+// prefix of either, or the name of its command, that matches no other run.
+func findActiveRun(runsDir string, name string) (runRecord, error) {
+	runs, err := listActiveRuns(runsDir)
+	if err != nil {
+		return runRecord{}, err
+	}
+	var matches []runRecord
+	for _, run := range runs {
+		if run.ID == name || run.RunID == name {
+			return run, nil
+		}
+		if strings.HasPrefix(run.ID, name) || strings.HasPrefix(run.RunID, name) || run.Command == name {
+			matches = append(matches, run)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return runRecord{}, fmt.Errorf("no run matches %v", name)
+	case 1:
+		return matches[0], nil
+	default:
+		return runRecord{}, fmt.Errorf("%v matches more than one run", name)
+	}
+}
+
+// cleanUp removes everything left behind by an abandoned run. The runtime
+// kills the container if it's somehow still running, as without fsark
+// there's nothing to stop it or collect its output.
+//
+// If the bundle can't be removed the record is kept, so that we try again
+// next time.
+func (r abandonedRun) cleanUp(mappings idMappings) error {
+	r.record.Runtime.runtime().deleteContainer(r.record.ID)
+	stopNetwork(r.record.Bundle)
+	os.RemoveAll(secretsDirectoryForBundle(r.record.Bundle))
+	if !r.record.KeepBundle {
+		err := removeMapped(r.record.Bundle, mappings)
+		if err != nil {
+			r.active.file.Close()
+			return err
+		}
+	}
+	r.active.release()
+	return nil
+}
+
+// cleanUpAbandonedRuns cleans up after all the abandoned runs, returning
+// those it cleaned up.
+func cleanUpAbandonedRuns(runsDir string, mappings idMappings) ([]runRecord, error) {
+	runs, err := findAbandonedRuns(runsDir)
+	if err != nil {
+		return nil, err
+	}
+	var cleaned []runRecord
+	for _, run := range runs {
+		err := run.cleanUp(mappings)
+		if err != nil {
+			logWarning("Failed to clean up after run %v of %v: %v", run.record.ID, run.record.Command, err)
+			continue
+		}
+		cleaned = append(cleaned, run.record)
+	}
+	return cleaned, nil
+}
+
+func runCleanup(ctx subcommandContext, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s cleanup\n", fsarkName)
+		return 2
+	}
+	stateDir, err := stateDirectory(ctx.conf, ctx.variables)
+	if err != nil {
+		logError("Failed to find state directory: %v", err)
+		return 1
+	}
+	mappings, err := resolveIDMappings()
+	if err != nil {
+		logError("Failed to work out user namespace mappings: %v", err)
+		return 1
+	}
+	cleaned, err := cleanUpAbandonedRuns(filepath.Join(stateDir, runsDirectoryName), mappings)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+	for _, record := range cleaned {
+		fmt.Printf("%s\t%s\t%s\n", record.ID, record.Command, record.Bundle)
+	}
+	return 0
+}
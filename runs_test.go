@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAbandonedRuns(t *testing.T) {
+	// keep the secrets directory for bundles within the bundle
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	runsDir := t.TempDir()
+	bundlesDir := t.TempDir()
+	mappings := singleIDMappings(os.Getuid(), os.Getgid())
+
+	newRun := func(id string, keepBundle bool) *activeRun {
+		bundle := filepath.Join(bundlesDir, id)
+		if err := os.MkdirAll(filepath.Join(bundle, "rootfs"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		run, err := recordRun(runsDir, runRecord{
+			ID:         id,
+			Command:    "mysh",
+			Bundle:     bundle,
+			KeepBundle: keepBundle,
+			PID:        os.Getpid(),
+			Started:    time.Now(),
+			Runtime:    runtimeRecord{Name: "runc", Path: "/nonexistent/runc"},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error recording run %v: %v", id, err)
+		}
+		return run
+	}
+
+	running := newRun("container-running", false)
+	defer running.release()
+	killed := newRun("container-killed", false)
+	kept := newRun("container-kept", true)
+	finished := newRun("container-finished", false)
+
+	// a run that exits normally removes its record, whereas one that's
+	// killed just loses its lock
+	finished.release()
+	killed.file.Close()
+	kept.file.Close()
+
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected records for the running, killed and kept runs, got %d", len(entries))
+	}
+
+	cleaned, err := cleanUpAbandonedRuns(runsDir, mappings)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cleaned) != 2 || cleaned[0].ID != "container-killed" || cleaned[1].ID != "container-kept" {
+		t.Errorf("Expected the killed and kept runs to be cleaned up, got %+v", cleaned)
+	}
+
+	if _, err := os.Stat(filepath.Join(bundlesDir, "container-killed")); !os.IsNotExist(err) {
+		t.Errorf("Expected bundle of killed run to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bundlesDir, "container-kept", "rootfs")); err != nil {
+		t.Errorf("Expected bundle that was asked to be kept to be left, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bundlesDir, "container-running", "rootfs")); err != nil {
+		t.Errorf("Expected bundle of running run to be left, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(runsDir, "container-running.json")); err != nil {
+		t.Errorf("Expected record of running run to be left, got %v", err)
+	}
+	for _, id := range []string{"container-killed", "container-kept"} {
+		if _, err := os.Stat(filepath.Join(runsDir, id+".json")); !os.IsNotExist(err) {
+			t.Errorf("Expected record of %v to be removed, got %v", id, err)
+		}
+	}
+
+	cleaned, err = cleanUpAbandonedRuns(filepath.Join(runsDir, "missing"), mappings)
+	if err != nil || len(cleaned) != 0 {
+		t.Errorf("Expected nothing to clean up in a missing directory, got %v, %v", cleaned, err)
+	}
+}
+
+func TestFindActiveRun(t *testing.T) {
+	runsDir := t.TempDir()
+	newRun := func(id string, runID string, command string) *activeRun {
+		run, err := recordRun(runsDir, runRecord{
+			ID:      id,
+			RunID:   runID,
+			Command: command,
+			Bundle:  filepath.Join("/tmp", id),
+			Started: time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error recording run %v: %v", id, err)
+		}
+		return run
+	}
+	training := newRun("container-111", "aaaa1111", "train")
+	defer training.release()
+	serving := newRun("container-222", "aabb2222", "serve")
+	defer serving.release()
+	// a killed run is no longer there to exec in
+	newRun("container-333", "cccc3333", "plot").file.Close()
+
+	testcases := []struct {
+		Name     string
+		Expected string
+	}{
+		{"aaaa1111", "container-111"},
+		{"container-222", "container-222"},
+		{"aab", "container-222"},
+		{"train", "container-111"},
+		{"aa", ""},
+		{"container-", ""},
+		{"cccc3333", ""},
+		{"plot", ""},
+	}
+	for _, testcase := range testcases {
+		run, err := findActiveRun(runsDir, testcase.Name)
+		if testcase.Expected == "" {
+			if err == nil {
+				t.Errorf("Expected error finding %v, got %v", testcase.Name, run.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error finding %v: %v", testcase.Name, err)
+		} else if run.ID != testcase.Expected {
+			t.Errorf("Expected %v to find %v, got %v", testcase.Name, testcase.Expected, run.ID)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// RuntimeConfig lets the config file describe an OCI runtime and the global
+// flags to pass to it. Runtimes are referred to by name, which is also taken
+// to be the type of the runtime unless Type is set, so that you can have more
+// than one configuration for the same runtime.
+type RuntimeConfig struct {
+	Type          string   `json:"type,omitempty"`
+	Path          string   `json:"path,omitempty"`
+	Root          string   `json:"root,omitempty"`
+	SystemdCgroup bool     `json:"systemd_cgroup,omitempty"`
+	Flags         []string `json:"flags,omitempty"`
+}
+
+type runtimeType struct {
+	// global flags needed for the runtime to run without root
+	rootlessFlags []string
+	// checks beyond it being present that the runtime can run rootless
+	probe func(path string) error
+}
+
+const defaultRuntime = "runc"
+
+var runtimeTypes = map[string]runtimeType{
+	"runc":  {},
+	"crun":  {},
+	"youki": {},
+	"runsc": {
+		rootlessFlags: []string{"--rootless"},
+		probe:         probeRunsc,
+	},
+}
+
+type ociRuntime struct {
+	name        string
+	path        string
+	globalFlags []string
+	probe       func(path string) error
+}
+
+func supportedRuntimeTypes() []string {
+	names := make([]string, 0, len(runtimeTypes))
+	for name := range runtimeTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func resolveRuntime(conf Config, commandConfig Wrapper, variables expansionVariables) (ociRuntime, error) {
+	name := conf.Runtime
+	if commandConfig.Runtime != "" {
+		name = commandConfig.Runtime
+	}
+	if name == "" {
+		name = defaultRuntime
+	}
+
+	runtimeConfig := conf.Runtimes[name]
+	typeName := runtimeConfig.Type
+	if typeName == "" {
+		typeName = name
+	}
+	kind, ok := runtimeTypes[typeName]
+	if !ok {
+		return ociRuntime{}, fmt.Errorf("unknown runtime type %q for runtime %q, expected one of %s", typeName, name, strings.Join(supportedRuntimeTypes(), ", "))
+	}
+
+	binary := runtimeConfig.Path
+	if binary == "" {
+		binary = typeName
+	}
+	binary, err := variables.expand(binary)
+	if err != nil {
+		return ociRuntime{}, fmt.Errorf("runtime %s path: %w", name, err)
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return ociRuntime{}, fmt.Errorf("failed to find runtime %s: %w", name, err)
+	}
+
+	flags := append([]string{}, kind.rootlessFlags...)
+	if runtimeConfig.Root != "" {
+		root, err := variables.expand(runtimeConfig.Root)
+		if err != nil {
+			return ociRuntime{}, fmt.Errorf("runtime %s root: %w", name, err)
+		}
+		flags = append(flags, "--root", root)
+	}
+	if runtimeConfig.SystemdCgroup {
+		flags = append(flags, "--systemd-cgroup")
+	}
+	extra, err := variables.expandList(runtimeConfig.Flags)
+	if err != nil {
+		return ociRuntime{}, fmt.Errorf("runtime %s flags: %w", name, err)
+	}
+	flags = append(flags, extra...)
+
+	return ociRuntime{
+		name:        name,
+		path:        path,
+		globalFlags: flags,
+		probe:       kind.probe,
+	}, nil
+}
+
+// command returns a command to run the given runtime subcommand, with the
+// configured global flags ahead of it.
+func (r ociRuntime) command(args ...string) *exec.Cmd {
+	fullArgs := append([]string{r.path}, r.globalFlags...)
+	fullArgs = append(fullArgs, args...)
+	logDebug("Running %v", strings.Join(fullArgs, " "))
+	return &exec.Cmd{
+		Path: r.path,
+		Args: fullArgs,
+	}
+}
+
+// checkRootless tries to spot ahead of time the cases where the runtime will
+// not be able to run our rootless containers, so that we can give the user a
+// more useful message than the runtime might. Running the runtime to check
+// it would slow down starting every command, so once it has passed that is
+// remembered in cacheDir until the runtime's executable changes.
+func (r ociRuntime) checkRootless(cacheDir string) error {
+	if err := probeUserNamespaces(); err != nil {
+		return err
+	}
+	stamp, err := stampFile(r.path)
+	if err != nil {
+		return fmt.Errorf("runtime %s (%s) is not usable: %w", r.name, r.path, err)
+	}
+	if _, ok := readCache(cacheDir, stamp); ok {
+		return nil
+	}
+	output, err := r.command("--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("runtime %s (%s) failed to report its version: %w: %s", r.name, r.path, err, bytes.TrimSpace(output))
+	}
+	if r.probe != nil {
+		if err := r.probe(r.path); err != nil {
+			return fmt.Errorf("runtime %s (%s) does not support rootless mode: %w", r.name, r.path, err)
+		}
+	}
+	writeCache(cacheDir, stamp, r.name)
+	return nil
+}
+
+func probeUserNamespaces() error {
+	checks := []struct {
+		path    string
+		problem string
+	}{
+		{"/proc/sys/user/max_user_namespaces", "user namespaces are disabled on this host"},
+		{"/proc/sys/kernel/unprivileged_userns_clone", "unprivileged user namespaces are disabled on this host"},
+	}
+	for _, check := range checks {
+		content, err := os.ReadFile(check.path)
+		if err != nil {
+			// not all kernels have all of these settings
+			continue
+		}
+		if strings.TrimSpace(string(content)) == "0" {
+			return fmt.Errorf("%s (%s is 0)", check.problem, check.path)
+		}
+	}
+	return nil
+}
+
+func probeRunsc(path string) error {
+	output, err := exec.Command(path, "flags").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to list flags: %w", err)
+	}
+	if !bytes.Contains(output, []byte("rootless")) {
+		return fmt.Errorf("no rootless flag available, a newer version of runsc is needed")
+	}
+	return nil
+}
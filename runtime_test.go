@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRuntimeFlags(t *testing.T) {
+	conf := Config{
+		Runtime: "sandbox",
+		Runtimes: map[string]RuntimeConfig{
+			"sandbox": {
+				Type:          "runsc",
+				Path:          "/bin/sh",
+				Root:          "${FSARK_TEST_ROOT}/runsc",
+				SystemdCgroup: true,
+				Flags:         []string{"--network=none"},
+			},
+		},
+	}
+	variables := expansionVariables{fsark: map[string]string{"FSARK_TEST_ROOT": "/run/user/1000"}}
+
+	runtime, err := resolveRuntime(conf, Wrapper{}, variables)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"--rootless", "--root", "/run/user/1000/runsc", "--systemd-cgroup", "--network=none"}
+	if !reflect.DeepEqual(runtime.globalFlags, expected) {
+		t.Errorf("Expected flags %v, got %v", expected, runtime.globalFlags)
+	}
+
+	cmd := runtime.command("run", "-b", "/tmp/bundle", "id")
+	expectedArgs := append([]string{"/bin/sh"}, expected...)
+	expectedArgs = append(expectedArgs, "run", "-b", "/tmp/bundle", "id")
+	if !reflect.DeepEqual(cmd.Args, expectedArgs) {
+		t.Errorf("Expected args %v, got %v", expectedArgs, cmd.Args)
+	}
+}
+
+func TestResolveRuntimeUnknownType(t *testing.T) {
+	_, err := resolveRuntime(Config{}, Wrapper{Runtime: "docker"}, expansionVariables{})
+	if err == nil {
+		t.Errorf("Expected error for unknown runtime type")
+	}
+}
+
+func TestCheckRootlessCached(t *testing.T) {
+	if err := probeUserNamespaces(); err != nil {
+		t.Skipf("Can't check runtimes here: %v", err)
+	}
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	path := filepath.Join(dir, "runc")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runtime := ociRuntime{name: "runc", path: path}
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.Mkdir(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := runtime.checkRootless(cacheDir); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	content, _ := os.ReadFile(calls)
+	if count := strings.Count(string(content), "--version"); count != 1 {
+		t.Errorf("Expected the runtime to be run once, got %d", count)
+	}
+
+	// a changed runtime is checked again
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.checkRootless(cacheDir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, _ = os.ReadFile(calls)
+	if count := strings.Count(string(content), "--version"); count != 2 {
+		t.Errorf("Expected the changed runtime to be run again, got %d", count)
+	}
+
+	// and without a cache it's run every time
+	if err := runtime.checkRootless(""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, _ = os.ReadFile(calls)
+	if count := strings.Count(string(content), "--version"); count != 3 {
+		t.Errorf("Expected the runtime to be run without a cache, got %d", count)
+	}
+}
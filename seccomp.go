@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Commands can set seccomp to one of:
+//
+//   - default: a profile modelled on docker's default, which allows the
+//     syscalls ordinary programs need and refuses the rest with EPERM. This
+//     is used if seccomp isn't set.
+//   - unconfined: no seccomp filtering at all
+//   - a path to a JSON file containing the seccomp section of an OCI runtime
+//     spec, which is used as is
+//
+// Syscalls that are unknown on the host architecture are skipped by the
+// runtimes, so the default profile lists syscalls for all architectures.
+
+const (
+	seccompDefault    = "default"
+	seccompUnconfined = "unconfined"
+)
+
+// defaultSeccompSyscalls are allowed regardless of the container's
+// capabilities.
+var defaultSeccompSyscalls = []string{
+	"accept", "accept4", "access", "adjtimex", "alarm", "bind", "brk",
+	"cachestat", "capget", "capset", "chdir", "chmod", "chown", "chown32",
+	"clock_adjtime", "clock_adjtime64", "clock_getres", "clock_getres_time64",
+	"clock_gettime", "clock_gettime64", "clock_nanosleep",
+	"clock_nanosleep_time64", "close", "close_range", "connect",
+	"copy_file_range", "creat", "dup", "dup2", "dup3", "epoll_create",
+	"epoll_create1", "epoll_ctl", "epoll_ctl_old", "epoll_pwait",
+	"epoll_pwait2", "epoll_wait", "epoll_wait_old", "eventfd", "eventfd2",
+	"execve", "execveat", "exit", "exit_group", "faccessat", "faccessat2",
+	"fadvise64", "fadvise64_64", "fallocate", "fanotify_mark", "fchdir",
+	"fchmod", "fchmodat", "fchmodat2", "fchown", "fchown32", "fchownat",
+	"fcntl", "fcntl64", "fdatasync", "fgetxattr", "flistxattr", "flock",
+	"fork", "fremovexattr", "fsetxattr", "fstat", "fstat64", "fstatat64",
+	"fstatfs", "fstatfs64", "fsync", "ftruncate", "ftruncate64", "futex",
+	"futex_requeue", "futex_time64", "futex_wait", "futex_waitv",
+	"futex_wake", "futimesat", "getcpu", "getcwd", "getdents", "getdents64",
+	"getegid", "getegid32", "geteuid", "geteuid32", "getgid", "getgid32",
+	"getgroups", "getgroups32", "getitimer", "getpeername", "getpgid",
+	"getpgrp", "getpid", "getppid", "getpriority", "getrandom", "getresgid",
+	"getresgid32", "getresuid", "getresuid32", "getrlimit",
+	"get_robust_list", "getrusage", "getsid", "getsockname", "getsockopt",
+	"get_thread_area", "gettid", "gettimeofday", "getuid", "getuid32",
+	"getxattr", "inotify_add_watch", "inotify_init", "inotify_init1",
+	"inotify_rm_watch", "io_cancel", "ioctl", "io_destroy", "io_getevents",
+	"io_pgetevents", "io_pgetevents_time64", "ioprio_get", "ioprio_set",
+	"io_setup", "io_submit", "ipc", "kill", "landlock_add_rule",
+	"landlock_create_ruleset", "landlock_restrict_self", "lchown",
+	"lchown32", "lgetxattr", "link", "linkat", "listen", "listxattr",
+	"llistxattr", "_llseek", "lremovexattr", "lseek", "lsetxattr", "lstat",
+	"lstat64", "madvise", "map_shadow_stack", "membarrier", "memfd_create",
+	"memfd_secret", "mincore", "mkdir", "mkdirat", "mknod", "mknodat",
+	"mlock", "mlock2", "mlockall", "mmap", "mmap2", "mprotect",
+	"mq_getsetattr", "mq_notify", "mq_open", "mq_timedreceive",
+	"mq_timedreceive_time64", "mq_timedsend", "mq_timedsend_time64",
+	"mq_unlink", "mremap", "msgctl", "msgget", "msgrcv", "msgsnd", "msync",
+	"munlock", "munlockall", "munmap", "name_to_handle_at", "nanosleep",
+	"newfstatat", "_newselect", "open", "openat", "openat2", "pause",
+	"pidfd_open", "pidfd_send_signal", "pipe", "pipe2", "pkey_alloc",
+	"pkey_free", "pkey_mprotect", "poll", "ppoll", "ppoll_time64", "prctl",
+	"pread64", "preadv", "preadv2", "prlimit64", "process_mrelease",
+	"process_vm_readv", "process_vm_writev", "pselect6", "pselect6_time64",
+	"ptrace", "pwrite64", "pwritev", "pwritev2", "read", "readahead",
+	"readlink", "readlinkat", "readv", "recv", "recvfrom", "recvmmsg",
+	"recvmmsg_time64", "recvmsg", "remap_file_pages", "removexattr",
+	"rename", "renameat", "renameat2", "restart_syscall", "rmdir", "rseq",
+	"rt_sigaction", "rt_sigpending", "rt_sigprocmask", "rt_sigqueueinfo",
+	"rt_sigreturn", "rt_sigsuspend", "rt_sigtimedwait",
+	"rt_sigtimedwait_time64", "rt_tgsigqueueinfo", "sched_getaffinity",
+	"sched_getattr", "sched_getparam", "sched_get_priority_max",
+	"sched_get_priority_min", "sched_getscheduler", "sched_rr_get_interval",
+	"sched_rr_get_interval_time64", "sched_setaffinity", "sched_setattr",
+	"sched_setparam", "sched_setscheduler", "sched_yield", "seccomp",
+	"select", "semctl", "semget", "semop", "semtimedop",
+	"semtimedop_time64", "send", "sendfile", "sendfile64", "sendmmsg",
+	"sendmsg", "sendto", "setfsgid", "setfsgid32", "setfsuid", "setfsuid32",
+	"setgid", "setgid32", "setgroups", "setgroups32", "setitimer", "setpgid",
+	"setpriority", "setregid", "setregid32", "setresgid", "setresgid32",
+	"setresuid", "setresuid32", "setreuid", "setreuid32", "setrlimit",
+	"set_robust_list", "setsid", "setsockopt", "set_thread_area",
+	"set_tid_address", "setuid", "setuid32", "setxattr", "shmat", "shmctl",
+	"shmdt", "shmget", "shutdown", "sigaltstack", "signalfd", "signalfd4",
+	"sigprocmask", "sigreturn", "socket", "socketcall", "socketpair",
+	"splice", "stat", "stat64", "statfs", "statfs64", "statx", "symlink",
+	"symlinkat", "sync", "sync_file_range", "syncfs", "sysinfo", "tee",
+	"tgkill", "time", "timer_create", "timer_delete", "timer_getoverrun",
+	"timer_gettime", "timer_gettime64", "timer_settime", "timer_settime64",
+	"timerfd_create", "timerfd_gettime", "timerfd_gettime64",
+	"timerfd_settime", "timerfd_settime64", "times", "tkill", "truncate",
+	"truncate64", "ugetrlimit", "umask", "uname", "unlink", "unlinkat",
+	"utime", "utimensat", "utimensat_time64", "utimes", "vfork", "vmsplice",
+	"wait4", "waitid", "waitpid", "write", "writev",
+
+	// architecture specific
+	"arch_prctl", "modify_ldt", "arm_fadvise64_64", "arm_sync_file_range",
+	"sync_file_range2", "breakpoint", "cacheflush", "set_tls",
+	"riscv_flush_icache", "s390_pci_mmio_read", "s390_pci_mmio_write",
+	"s390_runtime_instr",
+}
+
+// capabilitySeccompSyscalls are allowed only if the container has the
+// capability that guards them.
+var capabilitySeccompSyscalls = map[string][]string{
+	"CAP_BPF":             {"bpf"},
+	"CAP_DAC_READ_SEARCH": {"open_by_handle_at"},
+	"CAP_PERFMON":         {"perf_event_open"},
+	"CAP_SYS_ADMIN": {
+		"bpf", "clone", "clone3", "fanotify_init", "fsconfig", "fsmount",
+		"fsopen", "fspick", "lookup_dcookie", "mount", "mount_setattr",
+		"move_mount", "open_tree", "perf_event_open", "quotactl",
+		"quotactl_fd", "setdomainname", "sethostname", "setns", "syslog",
+		"umount", "umount2", "unshare",
+	},
+	"CAP_SYS_BOOT":       {"reboot"},
+	"CAP_SYS_CHROOT":     {"chroot"},
+	"CAP_SYS_MODULE":     {"delete_module", "init_module", "finit_module"},
+	"CAP_SYS_NICE":       {"get_mempolicy", "mbind", "set_mempolicy", "set_mempolicy_home_node"},
+	"CAP_SYS_PACCT":      {"acct"},
+	"CAP_SYS_PTRACE":     {"kcmp", "pidfd_getfd", "process_madvise"},
+	"CAP_SYS_RAWIO":      {"iopl", "ioperm"},
+	"CAP_SYS_TIME":       {"settimeofday", "stime", "clock_settime", "clock_settime64"},
+	"CAP_SYS_TTY_CONFIG": {"vhangup"},
+	"CAP_SYSLOG":         {"syslog"},
+}
+
+// cloneNamespaceFlags are the clone flags that create new namespaces, which
+// the default profile refuses without CAP_SYS_ADMIN
+const cloneNamespaceFlags = 0x7E020000
+
+var seccompArchitectures = map[string][]specs.Arch{
+	"amd64":   {specs.ArchX86_64, specs.ArchX86, specs.ArchX32},
+	"386":     {specs.ArchX86},
+	"arm64":   {specs.ArchAARCH64, specs.ArchARM},
+	"arm":     {specs.ArchARM},
+	"ppc64le": {specs.ArchPPC64LE},
+	"riscv64": {specs.ArchRISCV64},
+	"s390x":   {specs.ArchS390X, specs.ArchS390},
+}
+
+func validateSeccomp(setting string) error {
+	switch setting {
+	case "", seccompDefault, seccompUnconfined:
+		return nil
+	}
+	// Anything else is a path, but we insist it look like one so that a
+	// typo in one of the names above isn't mistaken for a file. A setting
+	// with variables in it can only be checked once they're expanded.
+	if !strings.Contains(setting, "/") && !strings.Contains(setting, "$") {
+		return fmt.Errorf("unknown seccomp setting %q, expected %s, %s or a path to a profile", setting, seccompDefault, seccompUnconfined)
+	}
+	return nil
+}
+
+// defaultSeccompProfile builds the default profile for the given
+// architecture, allowing the extra syscalls that the capabilities permit.
+func defaultSeccompProfile(goarch string, capabilities []string) *specs.LinuxSeccomp {
+	eperm := uint(1)
+	enosys := uint(38)
+
+	allowed := append([]string{}, defaultSeccompSyscalls...)
+	hasCapability := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, capability := range capabilities {
+		hasCapability[capability] = true
+		for _, syscall := range capabilitySeccompSyscalls[capability] {
+			if !seen[syscall] {
+				seen[syscall] = true
+				allowed = append(allowed, syscall)
+			}
+		}
+	}
+
+	syscalls := []specs.LinuxSyscall{
+		{
+			Names:  allowed,
+			Action: specs.ActAllow,
+		},
+		{
+			// Only allow the personality values that are harmless
+			Names:  []string{"personality"},
+			Action: specs.ActAllow,
+			Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0x0, Op: specs.OpEqualTo}},
+		},
+		{
+			Names:  []string{"personality"},
+			Action: specs.ActAllow,
+			Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0x8, Op: specs.OpEqualTo}},
+		},
+		{
+			Names:  []string{"personality"},
+			Action: specs.ActAllow,
+			Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0x20000, Op: specs.OpEqualTo}},
+		},
+		{
+			Names:  []string{"personality"},
+			Action: specs.ActAllow,
+			Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0x20008, Op: specs.OpEqualTo}},
+		},
+		{
+			Names:  []string{"personality"},
+			Action: specs.ActAllow,
+			Args:   []specs.LinuxSeccompArg{{Index: 0, Value: 0xffffffff, Op: specs.OpEqualTo}},
+		},
+	}
+
+	if !hasCapability["CAP_SYS_ADMIN"] {
+		// Allow clone as long as it's not making new namespaces. The flags
+		// for clone3 are in memory that seccomp can't inspect, so refuse
+		// it with ENOSYS, which makes libc fall back to clone.
+		cloneIndex := uint(0)
+		if goarch == "s390x" {
+			cloneIndex = 1
+		}
+		syscalls = append(syscalls,
+			specs.LinuxSyscall{
+				Names:  []string{"clone"},
+				Action: specs.ActAllow,
+				Args:   []specs.LinuxSeccompArg{{Index: cloneIndex, Value: cloneNamespaceFlags, ValueTwo: 0, Op: specs.OpMaskedEqual}},
+			},
+			specs.LinuxSyscall{
+				Names:    []string{"clone3"},
+				Action:   specs.ActErrno,
+				ErrnoRet: &enosys,
+			},
+		)
+	}
+
+	return &specs.LinuxSeccomp{
+		DefaultAction:   specs.ActErrno,
+		DefaultErrnoRet: &eperm,
+		Architectures:   seccompArchitectures[goarch],
+		Syscalls:        syscalls,
+	}
+}
+
+// loadSeccompProfile returns the seccomp section for the spec for the given
+// setting, or nil if the container should be unconfined.
+func loadSeccompProfile(setting string, capabilities []string) (*specs.LinuxSeccomp, error) {
+	switch setting {
+	case "", seccompDefault:
+		return defaultSeccompProfile(runtime.GOARCH, capabilities), nil
+	case seccompUnconfined:
+		return nil, nil
+	}
+	if err := validateSeccomp(setting); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(setting)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open seccomp profile: %w", err)
+	}
+	defer file.Close()
+	var profile specs.LinuxSeccomp
+	decoder := json.NewDecoder(file)
+	// docker's profile format is similar but not the same, so be strict to
+	// catch people using one of those by mistake
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile %v, it should be the seccomp section of an OCI runtime spec: %w", setting, err)
+	}
+	return &profile, nil
+}
+
+var knownSeccompActions = map[specs.LinuxSeccompAction]bool{
+	specs.ActKill:        true,
+	specs.ActKillProcess: true,
+	specs.ActKillThread:  true,
+	specs.ActTrap:        true,
+	specs.ActErrno:       true,
+	specs.ActTrace:       true,
+	specs.ActAllow:       true,
+	specs.ActLog:         true,
+	specs.ActNotify:      true,
+}
+
+func validateSeccompProfile(profile *specs.LinuxSeccomp) error {
+	if !knownSeccompActions[profile.DefaultAction] {
+		return fmt.Errorf("unknown seccomp default action %q", profile.DefaultAction)
+	}
+	for _, syscall := range profile.Syscalls {
+		if len(syscall.Names) == 0 {
+			return fmt.Errorf("seccomp rule with action %v has no syscall names", syscall.Action)
+		}
+		if !knownSeccompActions[syscall.Action] {
+			return fmt.Errorf("unknown seccomp action %q for %v", syscall.Action, strings.Join(syscall.Names, ", "))
+		}
+	}
+	return nil
+}
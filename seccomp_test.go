@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateSeccomp(t *testing.T) {
+	for _, setting := range []string{"", "default", "unconfined", "/etc/fsark/seccomp.json", "./profile.json", "$PROFILE", "${HOME}/seccomp.json"} {
+		if err := validateSeccomp(setting); err != nil {
+			t.Errorf("Unexpected error for %q: %v", setting, err)
+		}
+	}
+	for _, setting := range []string{"defualt", "none", "profile.json"} {
+		if err := validateSeccomp(setting); err == nil {
+			t.Errorf("Expected error for %q", setting)
+		}
+	}
+
+	// once expanded a variable has to have given a path
+	if _, err := loadSeccompProfile("defualt", nil); err == nil || !strings.Contains(err.Error(), "unknown seccomp setting") {
+		t.Errorf("Expected an expanded typo to be reported as one, got %v", err)
+	}
+}
+
+func allowedSyscalls(profile *specs.LinuxSeccomp) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, syscall := range profile.Syscalls {
+		if syscall.Action == specs.ActAllow && len(syscall.Args) == 0 {
+			for _, name := range syscall.Names {
+				allowed[name] = true
+			}
+		}
+	}
+	return allowed
+}
+
+func TestDefaultSeccompProfileCapabilities(t *testing.T) {
+	profile := defaultSeccompProfile("amd64", defaultCapabilities)
+	if profile.DefaultAction != specs.ActErrno {
+		t.Errorf("Expected default action %v, got %v", specs.ActErrno, profile.DefaultAction)
+	}
+	if len(profile.Architectures) == 0 || profile.Architectures[0] != specs.ArchX86_64 {
+		t.Errorf("Expected x86_64 architectures, got %v", profile.Architectures)
+	}
+	allowed := allowedSyscalls(profile)
+	for _, name := range []string{"read", "execve", "openat"} {
+		if !allowed[name] {
+			t.Errorf("Expected %v to be allowed", name)
+		}
+	}
+	for _, name := range []string{"mount", "unshare", "reboot", "clone"} {
+		if allowed[name] {
+			t.Errorf("Expected %v to be refused without capabilities", name)
+		}
+	}
+
+	admin := allowedSyscalls(defaultSeccompProfile("amd64", append([]string{"CAP_SYS_ADMIN"}, defaultCapabilities...)))
+	for _, name := range []string{"mount", "unshare", "clone", "clone3"} {
+		if !admin[name] {
+			t.Errorf("Expected %v to be allowed with CAP_SYS_ADMIN", name)
+		}
+	}
+	if err := validateSeccompProfile(profile); err != nil {
+		t.Errorf("Default profile is invalid: %v", err)
+	}
+}
+
+func TestLoadSeccompProfile(t *testing.T) {
+	if profile, err := loadSeccompProfile("unconfined", nil); err != nil || profile != nil {
+		t.Errorf("Expected no profile for unconfined, got %v, %v", profile, err)
+	}
+	if profile, err := loadSeccompProfile("", nil); err != nil || profile == nil {
+		t.Errorf("Expected default profile if not set, got %v, %v", profile, err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profile.json")
+	content := `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mount"], "action": "SCMP_ACT_ERRNO"}]}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	profile, err := loadSeccompProfile(path, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error loading profile: %v", err)
+	}
+	if profile.DefaultAction != specs.ActAllow || len(profile.Syscalls) != 1 || profile.Syscalls[0].Names[0] != "mount" {
+		t.Errorf("Profile not loaded as expected: %v", profile)
+	}
+
+	docker := filepath.Join(dir, "docker.json")
+	content = `{"defaultAction": "SCMP_ACT_ERRNO", "archMap": [], "syscalls": []}`
+	if err := os.WriteFile(docker, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	if _, err := loadSeccompProfile(docker, nil); err == nil {
+		t.Errorf("Expected error loading docker format profile")
+	}
+	if _, err := loadSeccompProfile(filepath.Join(dir, "missing.json"), nil); err == nil {
+		t.Errorf("Expected error loading missing profile")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Secrets are files on the host that are made available to the container
+// under /run/secrets/<name> rather than via the process environment, where
+// they would be visible in /proc/*/environ. The files are copied into a
+// private directory, which is in $XDG_RUNTIME_DIR (normally a tmpfs) if
+// available, and then bind mounted read-only over a tmpfs in the container.
+
+const secretsMountPath = "/run/secrets"
+
+func validateSecretName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	return nil
+}
+
+func secretsDirectoryForBundle(bundlePath string) string {
+	runtimeDir, ok := os.LookupEnv("XDG_RUNTIME_DIR")
+	if !ok || runtimeDir == "" {
+		return filepath.Join(bundlePath, "secrets")
+	}
+	_, id := filepath.Split(bundlePath)
+	return filepath.Join(runtimeDir, fmt.Sprintf("fsark-secrets-%s", id))
+}
+
+// secretsTmpfsMount is the tmpfs that the secrets are mounted over, so that
+// nothing from the image shows through alongside them.
+func secretsTmpfsMount() TmpfsMount {
+	return TmpfsMount{
+		Destination: secretsMountPath,
+		Options: []string{
+			"nosuid",
+			"noexec",
+			"nodev",
+			"mode=755",
+			"size=1024k",
+		},
+	}
+}
+
+func copySecret(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open secret %v: %w", source, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	if err != nil {
+		return fmt.Errorf("failed to create secret copy %v: %w", destination, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy secret %v: %w", source, err)
+	}
+	return out.Close()
+}
+
+// secretMounts lists the mounts for the secrets, from where they will be
+// staged for the bundle, without staging them.
+func secretMounts(bundlePath string, secrets map[string]string) ([]BindMount, error) {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		if err := validateSecretName(name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	secretsDir := secretsDirectoryForBundle(bundlePath)
+	mounts := make([]BindMount, 0, len(secrets))
+	for _, name := range names {
+		mounts = append(mounts, BindMount{
+			Source:      filepath.Join(secretsDir, name),
+			Destination: filepath.Join(secretsMountPath, name),
+			ReadOnly:    true,
+		})
+	}
+	return mounts, nil
+}
+
+// stageSecrets copies the secrets to where secretMounts said they would be.
+// This is kept apart from building the bundle so that a dry run doesn't
+// make copies of them.
+func stageSecrets(bundlePath string, secrets map[string]string) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	secretsDir := secretsDirectoryForBundle(bundlePath)
+	err := os.Mkdir(secretsDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	for name, source := range secrets {
+		if err := copySecret(source, filepath.Join(secretsDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
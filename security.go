@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Commands start with defaultCapabilities, and can add to or remove from them
+// with cap_add and cap_drop. Capabilities can be given with or without the
+// CAP_ prefix and in any case, and ALL stands for every capability. As the
+// container runs in a user namespace these only grant power over things the
+// namespace owns, not over the host.
+
+const allCapabilities = "ALL"
+
+// defaultMaskedPaths are hidden from the container, and defaultReadonlyPaths
+// are made read only, in addition to any a command asks for.
+var defaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/sys/firmware",
+	"/proc/scsi",
+}
+
+var defaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+func normalizeCapability(name string) (string, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(name))
+	if normalized == allCapabilities {
+		return normalized, nil
+	}
+	if !strings.HasPrefix(normalized, "CAP_") {
+		normalized = "CAP_" + normalized
+	}
+	if !knownCapabilities[normalized] {
+		return "", fmt.Errorf("unknown capability %q", name)
+	}
+	return normalized, nil
+}
+
+// resolveCapabilities applies the command's cap_add and cap_drop to the
+// default capabilities. Drops are applied after adds, so dropping ALL and
+// adding some back gives just those added.
+func resolveCapabilities(add []string, drop []string) ([]string, error) {
+	result := make(map[string]bool)
+	for _, capability := range defaultCapabilities {
+		result[capability] = true
+	}
+
+	dropped := make(map[string]bool)
+	dropAll := false
+	for _, name := range drop {
+		capability, err := normalizeCapability(name)
+		if err != nil {
+			return nil, fmt.Errorf("cap_drop: %w", err)
+		}
+		if capability == allCapabilities {
+			dropAll = true
+		}
+		dropped[capability] = true
+	}
+	if dropAll {
+		result = make(map[string]bool)
+	}
+	for capability := range dropped {
+		delete(result, capability)
+	}
+
+	for _, name := range add {
+		capability, err := normalizeCapability(name)
+		if err != nil {
+			return nil, fmt.Errorf("cap_add: %w", err)
+		}
+		if capability == allCapabilities {
+			for known := range knownCapabilities {
+				if !dropped[known] {
+					result[known] = true
+				}
+			}
+			continue
+		}
+		if dropped[capability] {
+			return nil, fmt.Errorf("capability %v is in both cap_add and cap_drop", capability)
+		}
+		result[capability] = true
+	}
+
+	capabilities := make([]string, 0, len(result))
+	for capability := range result {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+	return capabilities, nil
+}
+
+func validateContainerPaths(setting string, paths []string) error {
+	for _, item := range paths {
+		if !path.IsAbs(item) {
+			return fmt.Errorf("%s: %q is not an absolute path", setting, item)
+		}
+	}
+	return nil
+}
+
+// securitySettings works out the restrictions on the container process from
+// the command's config.
+func (w Wrapper) securitySettings() (SecuritySettings, error) {
+	capabilities, err := resolveCapabilities(w.CapAdd, w.CapDrop)
+	if err != nil {
+		return SecuritySettings{}, err
+	}
+	seccomp, err := loadSeccompProfile(w.Seccomp, capabilities)
+	if err != nil {
+		return SecuritySettings{}, err
+	}
+	noNewPrivileges := true
+	if w.NoNewPrivileges != nil {
+		noNewPrivileges = *w.NoNewPrivileges
+	}
+	return SecuritySettings{
+		Capabilities:    capabilities,
+		NoNewPrivileges: noNewPrivileges,
+		MaskedPaths:     append(append([]string{}, defaultMaskedPaths...), w.MaskedPaths...),
+		ReadonlyPaths:   append(append([]string{}, defaultReadonlyPaths...), w.ReadonlyPaths...),
+		Seccomp:         seccomp,
+	}, nil
+}
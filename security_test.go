@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveCapabilities(t *testing.T) {
+	testcases := []struct {
+		Add      []string
+		Drop     []string
+		Expected []string
+	}{
+		{nil, nil, []string{"CAP_AUDIT_WRITE", "CAP_KILL"}},
+		{[]string{"net_raw"}, nil, []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_RAW"}},
+		{[]string{"CAP_CHOWN"}, []string{"kill"}, []string{"CAP_AUDIT_WRITE", "CAP_CHOWN"}},
+		{[]string{"chown"}, []string{"ALL"}, []string{"CAP_CHOWN"}},
+		{nil, []string{"all"}, []string{}},
+	}
+	for _, testcase := range testcases {
+		capabilities, err := resolveCapabilities(testcase.Add, testcase.Drop)
+		if err != nil {
+			t.Errorf("Unexpected error for %v %v: %v", testcase.Add, testcase.Drop, err)
+			continue
+		}
+		if !reflect.DeepEqual(capabilities, testcase.Expected) {
+			t.Errorf("Expected %v for %v %v, got %v", testcase.Expected, testcase.Add, testcase.Drop, capabilities)
+		}
+	}
+
+	all, err := resolveCapabilities([]string{"ALL"}, []string{"SYS_ADMIN"})
+	if err != nil {
+		t.Fatalf("Unexpected error adding all: %v", err)
+	}
+	if len(all) != len(knownCapabilities)-1 {
+		t.Errorf("Expected all capabilities but one, got %v", all)
+	}
+	for _, capability := range all {
+		if capability == "CAP_SYS_ADMIN" {
+			t.Errorf("Expected CAP_SYS_ADMIN to be dropped")
+		}
+	}
+
+	invalid := []struct {
+		Add  []string
+		Drop []string
+	}{
+		{[]string{"CAP_MAGIC"}, nil},
+		{nil, []string{"flying"}},
+		{[]string{"NET_RAW"}, []string{"CAP_NET_RAW"}},
+	}
+	for _, testcase := range invalid {
+		if _, err := resolveCapabilities(testcase.Add, testcase.Drop); err == nil {
+			t.Errorf("Expected error for %v %v", testcase.Add, testcase.Drop)
+		}
+	}
+}
+
+func TestSecuritySettings(t *testing.T) {
+	security, err := Wrapper{Seccomp: seccompUnconfined}.securitySettings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !security.NoNewPrivileges {
+		t.Errorf("Expected no_new_privileges to default to true")
+	}
+	if !reflect.DeepEqual(security.MaskedPaths, defaultMaskedPaths) {
+		t.Errorf("Expected default masked paths, got %v", security.MaskedPaths)
+	}
+
+	allowed := false
+	security, err = Wrapper{
+		Seccomp:         seccompUnconfined,
+		NoNewPrivileges: &allowed,
+		MaskedPaths:     []string{"/proc/cpuinfo"},
+	}.securitySettings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if security.NoNewPrivileges {
+		t.Errorf("Expected no_new_privileges to be turned off")
+	}
+	if security.MaskedPaths[len(security.MaskedPaths)-1] != "/proc/cpuinfo" || len(security.MaskedPaths) != len(defaultMaskedPaths)+1 {
+		t.Errorf("Expected extra masked path after the defaults, got %v", security.MaskedPaths)
+	}
+
+	if err := validateContainerPaths("masked_paths", []string{"proc/cpuinfo"}); err == nil {
+		t.Errorf("Expected error for relative masked path")
+	}
+}
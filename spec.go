@@ -1,70 +1,49 @@
 package main
 
-type SpecUser struct {
-	UID uint `json:"uid"`
-	GID uint `json:"gid"`
-}
-
-// On linux rlim_t is unsigned long
-type SpecLimit struct {
-	TypeVal string `json:"type"`
-	Hard    uint32 `json:"hard"`
-	Soft    uint32 `json:"soft"`
-}
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
 
-type SpecProcess struct {
-	Terminal        bool                `json:"terminal"`
-	User            SpecUser            `json:"user"`
-	Args            []string            `json:"args"`
-	Env             []string            `json:"env"`
-	Cwd             string              `json:"cwd"`
-	Capabilities    map[string][]string `json:"capabilities"`
-	Rlimits         []SpecLimit         `json:"rlimits"`
-	NoNewPrivileges bool                `json:"noNewPrivileges"`
-}
-
-type SpecRoot struct {
-	Path     string `json:"path"`
-	Readonly bool   `json:"readonly"`
-}
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
 
-type SpecMount struct {
-	Destination string   `json:"destination"`
-	TypeVal     string   `json:"type"`
-	Source      string   `json:"source"`
-	Options     []string `json:"options,omitempty"`
-}
-
-type SpecMapping struct {
-	ContainerID int `json:"containerID"`
-	HostID      int `json:"hostID"`
-	Size        int `json:"size"`
+type BindMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readonly,omitempty"`
 }
 
-type SpecNamespace struct {
-	TypeVal string `json:"type"`
+// NetworkSettings describes how the container is connected to the network.
+// If Isolated is set the container gets its own network namespace, and if
+// ResolvConf is set that file is mounted as the container's resolv.conf.
+type NetworkSettings struct {
+	Isolated           bool
+	ResolvConf         string
+	CreateRuntimeHooks []specs.Hook
 }
 
-type SpecLinux struct {
-	UIDMappings   []SpecMapping   `json:"uidMappings"`
-	GIDMappings   []SpecMapping   `json:"gidMappings"`
-	Namespaces    []SpecNamespace `json:"namespaces"`
-	MaskedPaths   []string        `json:"maskedPaths"`
-	ReadonlyPaths []string        `json:"readonlyPaths"`
+// SecuritySettings describes the restrictions placed on the container
+// process. If Seccomp is nil then syscalls are not filtered.
+type SecuritySettings struct {
+	Capabilities    []string
+	NoNewPrivileges bool
+	MaskedPaths     []string
+	ReadonlyPaths   []string
+	Seccomp         *specs.LinuxSeccomp
 }
 
-type Spec struct {
-	OCIVersion string      `json:"ociVersion"`
-	Process    SpecProcess `json:"process"`
-	Root       SpecRoot    `json:"root"`
-	Hostname   string      `json:"hostname"`
-	Mounts     []SpecMount `json:"mounts"`
-	Linux      SpecLinux   `json:"linux"`
+// defaultCapabilities are the capabilities the container process has within
+// its user namespace.
+var defaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_KILL",
 }
 
-type BindMount struct {
-	Source      string
+type TmpfsMount struct {
 	Destination string
+	Options     []string
 }
 
 func CreateRootlessSpec(
@@ -72,46 +51,45 @@ func CreateRootlessSpec(
 	env []string,
 	workingDirectory string,
 	rootfs string,
+	tmpfs TmpfsSettings,
+	tmpfsMounts []TmpfsMount,
 	additionalMountPaths []BindMount,
-	uid int,
-	gid int,
-	hostNetworking bool,
-) Spec {
-	caps := []string{
-		"CAP_AUDIT_WRITE",
-		"CAP_KILL",
-	}
+	mappings idMappings,
+	network NetworkSettings,
+	security SecuritySettings,
+	terminal bool,
+) specs.Spec {
+	caps := security.Capabilities
 
 	newenv := []string{
 		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
 	}
 	newenv = append(newenv, env...)
 
-	process := SpecProcess{
-		Terminal: true,
-		User:     SpecUser{UID: 0, GID: 0},
+	process := &specs.Process{
+		Terminal: terminal,
+		User:     specs.User{UID: 0, GID: 0},
 		Args:     args,
 		Env:      newenv,
 		Cwd:      workingDirectory,
-		Capabilities: map[string][]string{
-			"bounding":  caps,
-			"effective": caps,
-			"permitted": caps,
-			"ambient":   caps,
+		Capabilities: &specs.LinuxCapabilities{
+			Bounding:  caps,
+			Effective: caps,
+			Permitted: caps,
+			Ambient:   caps,
 		},
-		Rlimits:         []SpecLimit{},
-		NoNewPrivileges: true,
+		NoNewPrivileges: security.NoNewPrivileges,
 	}
 
-	mounts := []SpecMount{
-		SpecMount{
+	mounts := []specs.Mount{
+		{
 			Destination: "/proc",
-			TypeVal:     "proc",
+			Type:        "proc",
 			Source:      "proc",
 		},
-		SpecMount{
+		{
 			Destination: "/dev",
-			TypeVal:     "tmpfs",
+			Type:        "tmpfs",
 			Source:      "tmpfs",
 			Options: []string{
 				"nosuid",
@@ -120,9 +98,9 @@ func CreateRootlessSpec(
 				"size=65536k",
 			},
 		},
-		SpecMount{
+		{
 			Destination: "/dev/pts",
-			TypeVal:     "devpts",
+			Type:        "devpts",
 			Source:      "devpts",
 			Options: []string{
 				"nosuid",
@@ -132,21 +110,15 @@ func CreateRootlessSpec(
 				"mode=0620",
 			},
 		},
-		SpecMount{
+		{
 			Destination: "/dev/shm",
-			TypeVal:     "tmpfs",
+			Type:        "tmpfs",
 			Source:      "shm",
-			Options: []string{
-				"nosuid",
-				"noexec",
-				"nodev",
-				"mode=1777",
-				"size=65536k",
-			},
+			Options:     tmpfs.shmOptions(),
 		},
-		SpecMount{
+		{
 			Destination: "/dev/mqueue",
-			TypeVal:     "mqueue",
+			Type:        "mqueue",
 			Source:      "mqueue",
 			Options: []string{
 				"nosuid",
@@ -154,9 +126,9 @@ func CreateRootlessSpec(
 				"nodev",
 			},
 		},
-		SpecMount{
+		{
 			Destination: "/sys",
-			TypeVal:     "none",
+			Type:        "none",
 			Source:      "/sys",
 			Options: []string{
 				"rbind",
@@ -166,19 +138,15 @@ func CreateRootlessSpec(
 				"ro",
 			},
 		},
-		SpecMount{
+		{
 			Destination: "/tmp",
-			TypeVal:     "tmpfs",
+			Type:        "tmpfs",
 			Source:      "tmpfs",
-			Options: []string{
-				"nosuid",
-				"noexec",
-				"nodev",
-			},
+			Options:     tmpfs.tmpOptions(),
 		},
-		SpecMount{
+		{
 			Destination: "/sys/fs/cgroup",
-			TypeVal:     "cgroup",
+			Type:        "cgroup",
 			Source:      "cgroup",
 			Options: []string{
 				"nosuid",
@@ -190,11 +158,11 @@ func CreateRootlessSpec(
 		},
 	}
 
-	if hostNetworking {
-		mounts = append(mounts, SpecMount{
+	if network.ResolvConf != "" {
+		mounts = append(mounts, specs.Mount{
 			Destination: "/etc/resolv.conf",
-			TypeVal:     "none",
-			Source:      "/etc/resolv.conf",
+			Type:        "none",
+			Source:      network.ResolvConf,
 			Options: []string{
 				"bind",
 				"nosuid",
@@ -205,10 +173,19 @@ func CreateRootlessSpec(
 		})
 	}
 
+	for _, tmpfsMount := range tmpfsMounts {
+		mounts = append(mounts, specs.Mount{
+			Destination: tmpfsMount.Destination,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     tmpfsMount.Options,
+		})
+	}
+
 	for _, additionalMount := range additionalMountPaths {
-		additional := SpecMount{
+		additional := specs.Mount{
 			Destination: additionalMount.Destination,
-			TypeVal:     "none",
+			Type:        "none",
 			Source:      additionalMount.Source,
 			Options: []string{
 				"bind",
@@ -217,62 +194,227 @@ func CreateRootlessSpec(
 				"nodev",
 			},
 		}
+		if additionalMount.ReadOnly {
+			additional.Options = append(additional.Options, "ro")
+		}
 		mounts = append(mounts, additional)
 	}
 
-	linux := SpecLinux{
-		UIDMappings: []SpecMapping{
-			SpecMapping{
-				ContainerID: 0,
-				HostID:      uid,
-				Size:        1,
-			},
-		},
-		GIDMappings: []SpecMapping{
-			SpecMapping{
-				ContainerID: 0,
-				HostID:      gid,
-				Size:        1,
-			},
-		},
-		Namespaces: []SpecNamespace{
-			SpecNamespace{TypeVal: "pid"},
-			SpecNamespace{TypeVal: "ipc"},
-			SpecNamespace{TypeVal: "uts"},
-			SpecNamespace{TypeVal: "mount"},
-			SpecNamespace{TypeVal: "cgroup"},
-			SpecNamespace{TypeVal: "user"},
-		},
-		MaskedPaths: []string{
-			"/proc/acpi",
-			"/proc/asound",
-			"/proc/kcore",
-			"/proc/keys",
-			"/proc/latency_stats",
-			"/proc/timer_list",
-			"/proc/timer_stats",
-			"/proc/sched_debug",
-			"/sys/firmware",
-			"/proc/scsi",
-		},
-		ReadonlyPaths: []string{
-			"/proc/bus",
-			"/proc/fs",
-			"/proc/irq",
-			"/proc/sys",
-			"/proc/sysrq-trigger",
+	linux := &specs.Linux{
+		UIDMappings: mappings.UIDs,
+		GIDMappings: mappings.GIDs,
+		Namespaces: []specs.LinuxNamespace{
+			{Type: specs.PIDNamespace},
+			{Type: specs.IPCNamespace},
+			{Type: specs.UTSNamespace},
+			{Type: specs.MountNamespace},
+			{Type: specs.CgroupNamespace},
+			{Type: specs.UserNamespace},
 		},
+		MaskedPaths:   security.MaskedPaths,
+		ReadonlyPaths: security.ReadonlyPaths,
+		Seccomp:       security.Seccomp,
+	}
+
+	if network.Isolated {
+		linux.Namespaces = append(linux.Namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	}
+
+	var hooks *specs.Hooks
+	if len(network.CreateRuntimeHooks) > 0 {
+		hooks = &specs.Hooks{
+			CreateRuntime: network.CreateRuntimeHooks,
+		}
 	}
 
-	return Spec{
-		OCIVersion: "1.0.2-dev",
-		Process:    process,
-		Root: SpecRoot{
+	return specs.Spec{
+		Version: specs.Version,
+		Process: process,
+		Root: &specs.Root{
 			Path:     rootfs,
 			Readonly: true,
 		},
 		Hostname: "fsark",
 		Mounts:   mounts,
+		Hooks:    hooks,
 		Linux:    linux,
 	}
 }
+
+var knownCapabilities = map[string]bool{
+	"CAP_AUDIT_CONTROL":      true,
+	"CAP_AUDIT_READ":         true,
+	"CAP_AUDIT_WRITE":        true,
+	"CAP_BLOCK_SUSPEND":      true,
+	"CAP_BPF":                true,
+	"CAP_CHECKPOINT_RESTORE": true,
+	"CAP_CHOWN":              true,
+	"CAP_DAC_OVERRIDE":       true,
+	"CAP_DAC_READ_SEARCH":    true,
+	"CAP_FOWNER":             true,
+	"CAP_FSETID":             true,
+	"CAP_IPC_LOCK":           true,
+	"CAP_IPC_OWNER":          true,
+	"CAP_KILL":               true,
+	"CAP_LEASE":              true,
+	"CAP_LINUX_IMMUTABLE":    true,
+	"CAP_MAC_ADMIN":          true,
+	"CAP_MAC_OVERRIDE":       true,
+	"CAP_MKNOD":              true,
+	"CAP_NET_ADMIN":          true,
+	"CAP_NET_BIND_SERVICE":   true,
+	"CAP_NET_BROADCAST":      true,
+	"CAP_NET_RAW":            true,
+	"CAP_PERFMON":            true,
+	"CAP_SETFCAP":            true,
+	"CAP_SETGID":             true,
+	"CAP_SETPCAP":            true,
+	"CAP_SETUID":             true,
+	"CAP_SYSLOG":             true,
+	"CAP_SYS_ADMIN":          true,
+	"CAP_SYS_BOOT":           true,
+	"CAP_SYS_CHROOT":         true,
+	"CAP_SYS_MODULE":         true,
+	"CAP_SYS_NICE":           true,
+	"CAP_SYS_PACCT":          true,
+	"CAP_SYS_PTRACE":         true,
+	"CAP_SYS_RAWIO":          true,
+	"CAP_SYS_RESOURCE":       true,
+	"CAP_SYS_TIME":           true,
+	"CAP_SYS_TTY_CONFIG":     true,
+	"CAP_WAKE_ALARM":         true,
+}
+
+var knownNamespaces = map[specs.LinuxNamespaceType]bool{
+	specs.PIDNamespace:     true,
+	specs.NetworkNamespace: true,
+	specs.MountNamespace:   true,
+	specs.IPCNamespace:     true,
+	specs.UTSNamespace:     true,
+	specs.UserNamespace:    true,
+	specs.CgroupNamespace:  true,
+	specs.TimeNamespace:    true,
+}
+
+// isBindMount is true for mounts of a path from the host, which runtimes
+// recognise by a bind option as well as by type.
+func isBindMount(mount specs.Mount) bool {
+	if mount.Type == "bind" {
+		return true
+	}
+	for _, option := range mount.Options {
+		if option == "bind" || option == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSpec checks a generated spec for mistakes that the runtime would
+// otherwise report with a less helpful error, or worse, silently accept.
+func validateSpec(spec specs.Spec) error {
+	if spec.Version != specs.Version {
+		return fmt.Errorf("spec version is %q, expected %q", spec.Version, specs.Version)
+	}
+
+	if spec.Root == nil || spec.Root.Path == "" {
+		return fmt.Errorf("spec has no root filesystem")
+	}
+
+	if spec.Process == nil {
+		return fmt.Errorf("spec has no process")
+	}
+	if len(spec.Process.Args) == 0 {
+		return fmt.Errorf("spec has no command to run")
+	}
+	if !path.IsAbs(spec.Process.Cwd) {
+		return fmt.Errorf("working directory %q is not an absolute path", spec.Process.Cwd)
+	}
+	for _, item := range spec.Process.Env {
+		if !strings.Contains(item, "=") || strings.HasPrefix(item, "=") {
+			return fmt.Errorf("environment entry %q is not of the form KEY=value", item)
+		}
+	}
+	if spec.Process.Capabilities != nil {
+		sets := [][]string{
+			spec.Process.Capabilities.Bounding,
+			spec.Process.Capabilities.Effective,
+			spec.Process.Capabilities.Permitted,
+			spec.Process.Capabilities.Inheritable,
+			spec.Process.Capabilities.Ambient,
+		}
+		for _, set := range sets {
+			for _, capability := range set {
+				if !knownCapabilities[capability] {
+					return fmt.Errorf("unknown capability %q", capability)
+				}
+			}
+		}
+	}
+
+	for _, mount := range spec.Mounts {
+		if !path.IsAbs(mount.Destination) {
+			return fmt.Errorf("mount destination %q is not an absolute path", mount.Destination)
+		}
+		if isBindMount(mount) && !filepath.IsAbs(mount.Source) {
+			return fmt.Errorf("bind mount source %q for %v is not an absolute path", mount.Source, mount.Destination)
+		}
+	}
+
+	if spec.Hooks != nil {
+		hooks := append(append([]specs.Hook{}, spec.Hooks.CreateRuntime...), spec.Hooks.CreateContainer...)
+		hooks = append(hooks, spec.Hooks.StartContainer...)
+		hooks = append(hooks, spec.Hooks.Poststart...)
+		hooks = append(hooks, spec.Hooks.Poststop...)
+		for _, hook := range hooks {
+			if !filepath.IsAbs(hook.Path) {
+				return fmt.Errorf("hook path %q is not an absolute path", hook.Path)
+			}
+		}
+	}
+
+	if spec.Linux == nil {
+		return fmt.Errorf("spec has no linux section")
+	}
+	seen := make(map[specs.LinuxNamespaceType]bool)
+	for _, namespace := range spec.Linux.Namespaces {
+		if !knownNamespaces[namespace.Type] {
+			return fmt.Errorf("unknown namespace type %q", namespace.Type)
+		}
+		if seen[namespace.Type] {
+			return fmt.Errorf("namespace %q is listed more than once", namespace.Type)
+		}
+		seen[namespace.Type] = true
+	}
+	if seen[specs.UserNamespace] && (len(spec.Linux.UIDMappings) == 0 || len(spec.Linux.GIDMappings) == 0) {
+		return fmt.Errorf("spec has a user namespace but no uid or gid mappings")
+	}
+	for _, mapping := range append(append([]specs.LinuxIDMapping{}, spec.Linux.UIDMappings...), spec.Linux.GIDMappings...) {
+		if mapping.Size == 0 {
+			return fmt.Errorf("id mapping for container id %d has zero size", mapping.ContainerID)
+		}
+	}
+	if seen[specs.UserNamespace] {
+		// the runtime becomes root in the namespace to set up the container
+		// before switching to the process's user
+		if _, ok := mapID(0, spec.Linux.UIDMappings); !ok {
+			return fmt.Errorf("root uid is not mapped into the container")
+		}
+		if _, ok := mapID(0, spec.Linux.GIDMappings); !ok {
+			return fmt.Errorf("root gid is not mapped into the container")
+		}
+		if _, ok := mapID(spec.Process.User.UID, spec.Linux.UIDMappings); !ok {
+			return fmt.Errorf("process uid %d is not mapped into the container", spec.Process.User.UID)
+		}
+		if _, ok := mapID(spec.Process.User.GID, spec.Linux.GIDMappings); !ok {
+			return fmt.Errorf("process gid %d is not mapped into the container", spec.Process.User.GID)
+		}
+	}
+	if spec.Linux.Seccomp != nil {
+		if err := validateSeccompProfile(spec.Linux.Seccomp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
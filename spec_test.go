@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Run the tests with -update to regenerate the golden files after an
+// intentional change to the generated specs.
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestCreateRootlessSpecGolden(t *testing.T) {
+	args := []string{"python3", "main.py"}
+	env := []string{"USER=alice", "FSARK=1"}
+	mounts := []BindMount{
+		{Source: "/home/alice/project", Destination: "/ark"},
+		{Source: "/data", Destination: "/data", ReadOnly: true},
+	}
+	testcases := []struct {
+		Name          string
+		TmpfsSettings TmpfsSettings
+		Tmpfs         []TmpfsMount
+		Network       NetworkSettings
+		Command       Wrapper
+		Mappings      *idMappings
+		Seccomp       bool
+		Terminal      bool
+	}{
+		{Name: "default", Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"}},
+		{Name: "terminal", Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"}, Terminal: true},
+		{Name: "network_none", Network: NetworkSettings{Isolated: true}},
+		{
+			Name: "network_slirp",
+			Network: NetworkSettings{
+				Isolated:   true,
+				ResolvConf: "/bundle/resolv.conf",
+				CreateRuntimeHooks: []specs.Hook{
+					{Path: "/usr/local/bin/fsark", Args: []string{"/usr/local/bin/fsark"}, Env: []string{"FSARK_HOOK=network"}},
+				},
+			},
+		},
+		{
+			Name:    "secrets",
+			Tmpfs:   []TmpfsMount{secretsTmpfsMount()},
+			Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"},
+		},
+		{
+			Name:    "seccomp_default",
+			Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"},
+			Seccomp: true,
+		},
+		{
+			Name:          "tmpfs_sizes",
+			Network:       NetworkSettings{ResolvConf: "/etc/resolv.conf"},
+			TmpfsSettings: TmpfsSettings{ShmSize: "2g", TmpSize: "512m", TmpExec: true},
+			Tmpfs:         []TmpfsMount{{Destination: "/scratch", Options: []string{"nosuid", "nodev", "mode=1777", "size=1g"}}},
+		},
+		{
+			Name:    "subordinate_ids",
+			Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"},
+			Mappings: &idMappings{
+				UIDs: buildIDMappings(1000, []idRange{{Start: 100000, Count: 65536}}),
+				GIDs: buildIDMappings(1000, []idRange{{Start: 100000, Count: 65536}, {Start: 300000, Count: 1000}}),
+			},
+		},
+		{
+			Name:    "security_options",
+			Network: NetworkSettings{ResolvConf: "/etc/resolv.conf"},
+			Command: Wrapper{
+				CapAdd:          []string{"net_raw", "CAP_CHOWN"},
+				CapDrop:         []string{"AUDIT_WRITE"},
+				MaskedPaths:     []string{"/proc/cpuinfo"},
+				ReadonlyPaths:   []string{"/sys"},
+				NoNewPrivileges: new(bool),
+			},
+		},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.Name, func(t *testing.T) {
+			// The default seccomp profile depends on the host architecture,
+			// so it's generated for a fixed one here
+			command := testcase.Command
+			command.Seccomp = seccompUnconfined
+			security, err := command.securitySettings()
+			if err != nil {
+				t.Fatalf("Unexpected error from security settings: %v", err)
+			}
+			if testcase.Seccomp {
+				security.Seccomp = defaultSeccompProfile("amd64", security.Capabilities)
+			}
+
+			mappings := singleIDMappings(1000, 1000)
+			if testcase.Mappings != nil {
+				mappings = *testcase.Mappings
+			}
+
+			spec := CreateRootlessSpec(args, env, "/ark", "/bundle/rootfs", testcase.TmpfsSettings, testcase.Tmpfs, mounts, mappings, testcase.Network, security, testcase.Terminal)
+			if err := validateSpec(spec); err != nil {
+				t.Fatalf("Generated spec is invalid: %v", err)
+			}
+			content, err := json.MarshalIndent(spec, "", "\t")
+			if err != nil {
+				t.Fatalf("Failed to encode spec: %v", err)
+			}
+			content = append(content, '\n')
+
+			golden := filepath.Join("testdata", "spec", testcase.Name+".json")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+					t.Fatalf("Failed to create testdata directory: %v", err)
+				}
+				if err := os.WriteFile(golden, content, 0644); err != nil {
+					t.Fatalf("Failed to write golden file: %v", err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("Spec does not match %v, got:\n%s", golden, content)
+			}
+		})
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	valid := func() specs.Spec {
+		return CreateRootlessSpec([]string{"sh"}, nil, "/ark", "/bundle/rootfs", TmpfsSettings{}, nil, nil, singleIDMappings(1000, 1000), NetworkSettings{}, SecuritySettings{}, false)
+	}
+	if err := validateSpec(valid()); err != nil {
+		t.Fatalf("Unexpected error for default spec: %v", err)
+	}
+
+	testcases := []struct {
+		Name   string
+		Modify func(spec *specs.Spec)
+	}{
+		{"version", func(spec *specs.Spec) { spec.Version = "1.0.2-dev" }},
+		{"no root", func(spec *specs.Spec) { spec.Root = nil }},
+		{"no args", func(spec *specs.Spec) { spec.Process.Args = nil }},
+		{"relative cwd", func(spec *specs.Spec) { spec.Process.Cwd = "ark" }},
+		{"bad env", func(spec *specs.Spec) { spec.Process.Env = append(spec.Process.Env, "NOEQUALS") }},
+		{"unknown capability", func(spec *specs.Spec) {
+			spec.Process.Capabilities.Bounding = append(spec.Process.Capabilities.Bounding, "CAP_MAGIC")
+		}},
+		{"relative mount", func(spec *specs.Spec) {
+			spec.Mounts = append(spec.Mounts, specs.Mount{Destination: "data", Type: "bind", Source: "/data"})
+		}},
+		{"relative bind source", func(spec *specs.Spec) {
+			spec.Mounts = append(spec.Mounts, specs.Mount{Destination: "/data", Type: "bind", Source: "data"})
+		}},
+		{"relative bind option source", func(spec *specs.Spec) {
+			spec.Mounts = append(spec.Mounts, specs.Mount{Destination: "/data", Type: "none", Source: "data", Options: []string{"rbind", "ro"}})
+		}},
+		{"relative generated bind source", func(spec *specs.Spec) {
+			generated := CreateRootlessSpec([]string{"sh"}, nil, "/ark", "/bundle/rootfs", TmpfsSettings{}, nil, []BindMount{{Source: "data", Destination: "/data"}}, singleIDMappings(1000, 1000), NetworkSettings{}, SecuritySettings{}, false)
+			*spec = generated
+		}},
+		{"relative hook", func(spec *specs.Spec) {
+			spec.Hooks = &specs.Hooks{CreateRuntime: []specs.Hook{{Path: "fsark"}}}
+		}},
+		{"duplicate namespace", func(spec *specs.Spec) {
+			spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.PIDNamespace})
+		}},
+		{"unknown namespace", func(spec *specs.Spec) {
+			spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: "magic"})
+		}},
+		{"no mappings", func(spec *specs.Spec) { spec.Linux.UIDMappings = nil }},
+		{"root not mapped", func(spec *specs.Spec) {
+			spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 1000, HostID: 1000, Size: 1}}
+			spec.Process.User.GID = 1000
+		}},
+		{"seccomp action", func(spec *specs.Spec) {
+			spec.Linux.Seccomp = &specs.LinuxSeccomp{DefaultAction: "SCMP_ACT_MAYBE"}
+		}},
+	}
+	for _, testcase := range testcases {
+		spec := valid()
+		testcase.Modify(&spec)
+		if err := validateSpec(spec); err == nil {
+			t.Errorf("Expected error for %v", testcase.Name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cacheDirectoryName  = "cache"
+	environmentSaltName = "environment.salt"
+)
+
+// fsark keeps per user state, such as provenance records, in a state
+// directory. This is state_dir from the config if set, otherwise
+// $FSARK_STATE_DIR, otherwise $XDG_STATE_HOME/fsark, falling back to
+// ~/.local/state/fsark.
+func stateDirectory(conf Config, variables expansionVariables) (string, error) {
+	if conf.StateDirectory != "" {
+		return variables.expand(conf.StateDirectory)
+	}
+	if dir, ok := os.LookupEnv("FSARK_STATE_DIR"); ok && dir != "" {
+		return dir, nil
+	}
+	if dir, ok := os.LookupEnv("XDG_STATE_HOME"); ok && dir != "" {
+		return filepath.Join(dir, "fsark"), nil
+	}
+	home, _ := variables.lookup("HOME")
+	if home == "" {
+		return "", fmt.Errorf("cannot find state directory as HOME is not set")
+	}
+	return filepath.Join(home, ".local", "state", "fsark"), nil
+}
+
+// stateSubdirectory returns the named directory within the state directory,
+// creating it if necessary.
+func stateSubdirectory(conf Config, variables expansionVariables, name string) (string, error) {
+	stateDir, err := stateDirectory(conf, variables)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(stateDir, name)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create state directory %v: %w", dir, err)
+	}
+	return dir, nil
+}
+
+func newRunID() (string, error) {
+	buffer := make([]byte, 8)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate run id: %w", err)
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// environmentSalt returns the secret salt for hashing environment variable
+// values in provenance records, creating it the first time. It's written
+// to a temporary file and linked into place, so that if two runs race to
+// create it they both end up using the same one.
+func environmentSalt(conf Config, variables expansionVariables) ([]byte, error) {
+	dir, err := stateSubdirectory(conf, variables, ".")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, environmentSaltName)
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		return salt, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read salt: %w", err)
+	}
+
+	salt = make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	file, err := os.CreateTemp(dir, environmentSaltName+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create salt: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(salt)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write salt: %w", err)
+	}
+	err = os.Link(file.Name(), path)
+	if errors.Is(err, fs.ErrExist) {
+		return os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create salt: %w", err)
+	}
+	return salt, nil
+}
+
+// cacheDirectory returns the named cache within the state directory, or an
+// empty string if there isn't one, in which case nothing is cached.
+func cacheDirectory(conf Config, variables expansionVariables, name string) string {
+	dir, err := stateSubdirectory(conf, variables, filepath.Join(cacheDirectoryName, name))
+	if err != nil {
+		logDebug("Not caching %v: %v", name, err)
+		return ""
+	}
+	return dir
+}
+
+// fileStamp identifies a version of a file well enough to tell whether
+// something worked out from it is still valid, without reading it.
+type fileStamp struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func stampFile(path string) (fileStamp, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{Path: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+type cacheEntry struct {
+	File  fileStamp `json:"file"`
+	Value string    `json:"value"`
+}
+
+// cacheEntryPath is named after the file's path, so each file has at most
+// one entry in a cache.
+func cacheEntryPath(dir string, path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readCache returns the value kept in the cache dir for the file, if there
+// is one and the file hasn't changed since.
+func readCache(dir string, stamp fileStamp) (string, bool) {
+	if dir == "" {
+		return "", false
+	}
+	content, err := os.ReadFile(cacheEntryPath(dir, stamp.Path))
+	if err != nil {
+		return "", false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return "", false
+	}
+	if entry.File.Path != stamp.Path || entry.File.Size != stamp.Size || !entry.File.ModTime.Equal(stamp.ModTime) {
+		return "", false
+	}
+	return entry.Value, true
+}
+
+// writeCache keeps the value for the file in the cache dir. As the cache is
+// only there to save time, failing to write it is only worth a debug message.
+func writeCache(dir string, stamp fileStamp, value string) {
+	if dir == "" {
+		return
+	}
+	err := func() error {
+		content, err := json.Marshal(cacheEntry{File: stamp, Value: value})
+		if err != nil {
+			return err
+		}
+		file, err := os.CreateTemp(dir, ".entry-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		_, err = file.Write(content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(file.Name(), cacheEntryPath(dir, stamp.Path))
+	}()
+	if err != nil {
+		logDebug("Failed to cache result for %v: %v", stamp.Path, err)
+	}
+}
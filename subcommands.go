@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// When fsark is run under its own name, rather than via a symlink named
+// after a command, the first argument selects one of these subcommands.
+
+const fsarkName = "fsark"
+
+type subcommandContext struct {
+	conf       Config
+	configData []byte
+	variables  expansionVariables
+	signals    <-chan os.Signal
+}
+
+type subcommand struct {
+	summary string
+	run     func(ctx subcommandContext, args []string) int
+}
+
+var subcommands map[string]subcommand
+
+func init() {
+	// this is set up in init as the help subcommand refers to the map
+	subcommands = map[string]subcommand{
+		"cleanup": {
+			summary: "clean up after runs whose fsark was killed before it could",
+			run:     runCleanup,
+		},
+		"exec": {
+			summary: "run a command, by default a shell, in a running container",
+			run:     runExec,
+		},
+		"explain": {
+			summary: "show the container spec and runtime command for a command without running it",
+			run:     runExplain,
+		},
+		"help": {
+			summary: "show this help",
+			run:     runHelp,
+		},
+		"history": {
+			summary: "list previous runs, or show the provenance record of one",
+			run:     runHistory,
+		},
+		"logs": {
+			summary: "show the output of a detached container",
+			run:     runLogs,
+		},
+		"ps": {
+			summary: "list detached containers",
+			run:     runPs,
+		},
+		"replay": {
+			summary: "run a previous run again with the same image and arguments",
+			run:     runReplay,
+		},
+		"rm": {
+			summary: "remove the logs and state of detached containers that have exited",
+			run:     runRm,
+		},
+		"stop": {
+			summary: "stop detached containers",
+			run:     runStop,
+		},
+		"volume": {
+			summary: "list or remove the volumes kept for commands",
+			run:     runVolume,
+		},
+		"wait": {
+			summary: "wait for detached containers to exit and print their exit codes",
+			run:     runWait,
+		},
+	}
+}
+
+func runHelp(ctx subcommandContext, args []string) int {
+	fmt.Fprintf(os.Stderr, "usage: %s <subcommand> [arguments]\n\nSubcommands:\n", fsarkName)
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%-10s %s\n", name, subcommands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nCommands from the config:\n")
+	commands := make([]string, 0, len(ctx.conf.Commands))
+	for name := range ctx.conf.Commands {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	for _, name := range commands {
+		fmt.Fprintf(os.Stderr, "\t%s\n", name)
+	}
+	return 0
+}
+
+func runSubcommand(ctx subcommandContext, args []string) int {
+	// subcommands can be made verbose like commands, with the option
+	// before the subcommand's name
+	for len(args) > 0 && args[0] == fsarkOptionPrefix+"verbose" {
+		fsarkLogger.setLevel(levelDebug)
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		runHelp(ctx, nil)
+		return 1
+	}
+	command, ok := subcommands[args[0]]
+	if !ok {
+		logError("Unknown subcommand %v, see %s help", args[0], fsarkName)
+		return 1
+	}
+	return command.run(ctx, args[1:])
+}
+
+func runHistory(ctx subcommandContext, args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	limit := flags.Int("n", 20, "show at most this many of the most recent runs, 0 for all")
+	commandName := flags.String("command", "", "only show runs of this command")
+	asJSON := flags.Bool("json", false, "output records as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s history [options] [run id]\n", fsarkName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	locations, err := resolveProvenanceLocations(ctx.conf, ctx.variables)
+	if err != nil {
+		logError("Failed to find provenance records: %v", err)
+		return 1
+	}
+	if !locations.enabled() {
+		logError("Provenance records are not enabled in the config")
+		return 1
+	}
+
+	if flags.NArg() > 0 {
+		record, err := locations.find(flags.Arg(0))
+		if err != nil {
+			logError("%v", err)
+			return 1
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "\t")
+		if err := encoder.Encode(record); err != nil {
+			logError("Failed to write record: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	records, err := locations.readAll()
+	if err != nil {
+		logError("Failed to read provenance records: %v", err)
+		return 1
+	}
+	if *commandName != "" {
+		filtered := records[:0]
+		for _, record := range records {
+			if record.Command == *commandName {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+	if (*limit > 0) && (len(records) > *limit) {
+		records = records[len(records)-*limit:]
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				logError("Failed to write record: %v", err)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "ID\tCOMMAND\tSTARTED\tDURATION\tEXIT\tIMAGE\tARGS\n")
+	for _, record := range records {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%v\t%d\t%s\t%s\n",
+			record.ID,
+			record.Command,
+			record.Start.Local().Format(time.RFC3339),
+			record.End.Sub(record.Start).Round(time.Second),
+			record.ExitCode,
+			record.Image,
+			strings.Join(record.Args, " "),
+		)
+	}
+	writer.Flush()
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Commands can change the size of /dev/shm with shm_size, the size of /tmp
+// with tmp_size, and allow programs to be run from /tmp with tmp_exec. They
+// can also ask for more tmpfs mounts with tmpfs. Sizes are in bytes, with an
+// optional k, m or g suffix, or a percentage of the host's memory.
+
+const defaultShmSize = "65536k"
+
+var tmpfsSizePattern = regexp.MustCompile(`^([0-9]+)(?:([kmg])(?:i?b)?|b)?$`)
+
+type TmpfsConfig struct {
+	Path string `json:"path"`
+	Size string `json:"size"`
+	Mode string `json:"mode"`
+	Exec bool   `json:"exec"`
+}
+
+// TmpfsSettings describes the tmpfs mounts the container has as standard.
+// The zero value gives the defaults.
+type TmpfsSettings struct {
+	ShmSize string
+	TmpSize string
+	TmpExec bool
+}
+
+// parseTmpfsSize checks a size is one tmpfs understands, and returns it in
+// the form we pass to the mount.
+func parseTmpfsSize(value string) (string, error) {
+	size := strings.ToLower(strings.TrimSpace(value))
+	if strings.HasSuffix(size, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(size, "%"), 10, 64)
+		if err != nil || percent == 0 || percent > 100 {
+			return "", fmt.Errorf("bad size %q, percentages must be from 1%% to 100%%", value)
+		}
+		return size, nil
+	}
+	// allow 1g, 1gb and 1gib, which all mean the same to tmpfs
+	match := tmpfsSizePattern.FindStringSubmatch(size)
+	if match == nil {
+		return "", fmt.Errorf("bad size %q, expected a number of bytes with an optional k, m or g suffix", value)
+	}
+	if number, _ := strconv.ParseUint(match[1], 10, 64); number == 0 {
+		return "", fmt.Errorf("bad size %q, it must be more than zero", value)
+	}
+	return match[1] + match[2], nil
+}
+
+func parseTmpfsMode(value string) (string, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		return "", fmt.Errorf("bad mode %q, expected octal permissions such as 1777", value)
+	}
+	return fmt.Sprintf("%o", mode), nil
+}
+
+func (c TmpfsConfig) mount() (TmpfsMount, error) {
+	if !path.IsAbs(c.Path) {
+		return TmpfsMount{}, fmt.Errorf("tmpfs path %q is not an absolute path", c.Path)
+	}
+	switch path.Clean(c.Path) {
+	case "/tmp":
+		return TmpfsMount{}, fmt.Errorf("use tmp_size and tmp_exec to configure /tmp")
+	case "/dev/shm":
+		return TmpfsMount{}, fmt.Errorf("use shm_size to configure /dev/shm")
+	case secretsMountPath:
+		return TmpfsMount{}, fmt.Errorf("%v is reserved for secrets", secretsMountPath)
+	}
+
+	options := []string{"nosuid", "nodev"}
+	if !c.Exec {
+		options = append(options, "noexec")
+	}
+	mode := "755"
+	if c.Mode != "" {
+		var err error
+		mode, err = parseTmpfsMode(c.Mode)
+		if err != nil {
+			return TmpfsMount{}, fmt.Errorf("tmpfs %v: %w", c.Path, err)
+		}
+	}
+	options = append(options, fmt.Sprintf("mode=%s", mode))
+	if c.Size != "" {
+		size, err := parseTmpfsSize(c.Size)
+		if err != nil {
+			return TmpfsMount{}, fmt.Errorf("tmpfs %v: %w", c.Path, err)
+		}
+		options = append(options, fmt.Sprintf("size=%s", size))
+	}
+	return TmpfsMount{Destination: path.Clean(c.Path), Options: options}, nil
+}
+
+// tmpfsSettings returns the settings for the standard tmpfs mounts and any
+// extra ones the command asks for.
+func (w Wrapper) tmpfsSettings() (TmpfsSettings, []TmpfsMount, error) {
+	settings := TmpfsSettings{TmpExec: w.TmpExec}
+	var err error
+	if w.ShmSize != "" {
+		settings.ShmSize, err = parseTmpfsSize(w.ShmSize)
+		if err != nil {
+			return TmpfsSettings{}, nil, fmt.Errorf("shm_size: %w", err)
+		}
+	}
+	if w.TmpSize != "" {
+		settings.TmpSize, err = parseTmpfsSize(w.TmpSize)
+		if err != nil {
+			return TmpfsSettings{}, nil, fmt.Errorf("tmp_size: %w", err)
+		}
+	}
+
+	mounts := make([]TmpfsMount, 0, len(w.Tmpfs))
+	seen := make(map[string]bool)
+	for _, config := range w.Tmpfs {
+		mount, err := config.mount()
+		if err != nil {
+			return TmpfsSettings{}, nil, err
+		}
+		if seen[mount.Destination] {
+			return TmpfsSettings{}, nil, fmt.Errorf("tmpfs %v is listed more than once", mount.Destination)
+		}
+		seen[mount.Destination] = true
+		mounts = append(mounts, mount)
+	}
+	return settings, mounts, nil
+}
+
+func (s TmpfsSettings) shmOptions() []string {
+	size := s.ShmSize
+	if size == "" {
+		size = defaultShmSize
+	}
+	return []string{
+		"nosuid",
+		"noexec",
+		"nodev",
+		"mode=1777",
+		fmt.Sprintf("size=%s", size),
+	}
+}
+
+func (s TmpfsSettings) tmpOptions() []string {
+	options := []string{"nosuid"}
+	if !s.TmpExec {
+		options = append(options, "noexec")
+	}
+	options = append(options, "nodev")
+	if s.TmpSize != "" {
+		options = append(options, fmt.Sprintf("size=%s", s.TmpSize))
+	}
+	return options
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTmpfsSize(t *testing.T) {
+	testcases := []struct {
+		Value    string
+		Expected string
+	}{
+		{"1048576", "1048576"},
+		{"512k", "512k"},
+		{"64M", "64m"},
+		{"2g", "2g"},
+		{"2GB", "2g"},
+		{"2GiB", "2g"},
+		{"100b", "100"},
+		{"50%", "50%"},
+	}
+	for _, testcase := range testcases {
+		size, err := parseTmpfsSize(testcase.Value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Value, err)
+			continue
+		}
+		if size != testcase.Expected {
+			t.Errorf("Expected %q for %q, got %q", testcase.Expected, testcase.Value, size)
+		}
+	}
+
+	for _, value := range []string{"", "0", "1t", "lots", "-1g", "0%", "150%", "1.5g"} {
+		if _, err := parseTmpfsSize(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestTmpfsSettings(t *testing.T) {
+	defaults, mounts, err := Wrapper{}.tmpfsSettings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Errorf("Expected no extra mounts, got %v", mounts)
+	}
+	if !reflect.DeepEqual(defaults.shmOptions(), []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}) {
+		t.Errorf("Unexpected default /dev/shm options %v", defaults.shmOptions())
+	}
+	if !reflect.DeepEqual(defaults.tmpOptions(), []string{"nosuid", "noexec", "nodev"}) {
+		t.Errorf("Unexpected default /tmp options %v", defaults.tmpOptions())
+	}
+
+	settings, mounts, err := Wrapper{
+		ShmSize: "2g",
+		TmpSize: "1g",
+		TmpExec: true,
+		Tmpfs: []TmpfsConfig{
+			{Path: "/scratch", Size: "4g", Mode: "1777"},
+			{Path: "/build/", Exec: true},
+		},
+	}.tmpfsSettings()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(settings.tmpOptions(), []string{"nosuid", "nodev", "size=1g"}) {
+		t.Errorf("Unexpected /tmp options %v", settings.tmpOptions())
+	}
+	expected := []TmpfsMount{
+		{Destination: "/scratch", Options: []string{"nosuid", "nodev", "noexec", "mode=1777", "size=4g"}},
+		{Destination: "/build", Options: []string{"nosuid", "nodev", "mode=755"}},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("Expected %v, got %v", expected, mounts)
+	}
+
+	invalid := []Wrapper{
+		{ShmSize: "big"},
+		{Tmpfs: []TmpfsConfig{{Path: "scratch"}}},
+		{Tmpfs: []TmpfsConfig{{Path: "/tmp"}}},
+		{Tmpfs: []TmpfsConfig{{Path: "/scratch", Mode: "999"}}},
+		{Tmpfs: []TmpfsConfig{{Path: "/scratch"}, {Path: "/scratch/"}}},
+	}
+	for _, command := range invalid {
+		if _, _, err := command.tmpfsSettings(); err == nil {
+			t.Errorf("Expected error for %v", command)
+		}
+	}
+}
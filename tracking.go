@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// If a command has track_files set then we snapshot the regular files in the
+// directory that is mounted as /ark before and after the run, and record in
+// the provenance record which files were there to start with and which were
+// created, modified or deleted by the run. Files that can't be read, say
+// because the command made them unreadable, are listed as such rather than
+// stopping the run, and left out of the changes.
+
+type trackedFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"mtime"`
+	SHA256   string    `json:"sha256"`
+}
+
+type fileChanges struct {
+	Inputs   []trackedFile `json:"inputs"`
+	Created  []trackedFile `json:"created,omitempty"`
+	Modified []trackedFile `json:"modified,omitempty"`
+	Deleted  []trackedFile `json:"deleted,omitempty"`
+
+	Unreadable []string `json:"unreadable,omitempty"`
+}
+
+type fileSnapshot map[string]trackedFile
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// snapshotFiles records all the regular files under root. If previous is not
+// nil, then files whose size and modification time match the previous
+// snapshot are assumed to be unchanged and are not hashed again. Files and
+// directories that can't be read are skipped with a warning, and returned
+// as well, and only failing to read root itself is an error.
+func snapshotFiles(root string, previous fileSnapshot) (fileSnapshot, []string, error) {
+	snapshot := make(fileSnapshot)
+	var unreadable []string
+	skip := func(path string, err error) error {
+		logWarning("Not tracking %v: %v", path, err)
+		relative, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		unreadable = append(unreadable, relative)
+		return nil
+	}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return skip(path, err)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return skip(path, err)
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		file := trackedFile{
+			Path:     relative,
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		}
+		if old, ok := previous[relative]; ok && old.Size == file.Size && old.Modified.Equal(file.Modified) {
+			file.SHA256 = old.SHA256
+		} else {
+			file.SHA256, err = hashFile(path)
+			if err != nil {
+				return skip(path, fmt.Errorf("failed to hash: %w", err))
+			}
+		}
+		snapshot[relative] = file
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to snapshot %v: %w", root, err)
+	}
+	return snapshot, unreadable, nil
+}
+
+func (s fileSnapshot) sorted() []trackedFile {
+	files := make([]trackedFile, 0, len(s))
+	for _, file := range s {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// compareSnapshots works out the changes between two snapshots, leaving out
+// any path that was unreadable in either of them, or is in a directory that
+// was.
+func compareSnapshots(before fileSnapshot, after fileSnapshot, unreadable []string) fileChanges {
+	sorted := append([]string(nil), unreadable...)
+	sort.Strings(sorted)
+	var changes fileChanges
+	for index, path := range sorted {
+		if index == 0 || path != sorted[index-1] {
+			changes.Unreadable = append(changes.Unreadable, path)
+		}
+	}
+	isUnreadable := func(path string) bool {
+		for _, skipped := range changes.Unreadable {
+			if path == skipped || strings.HasPrefix(path, skipped+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	changes.Inputs = before.sorted()
+	for _, file := range after.sorted() {
+		if isUnreadable(file.Path) {
+			continue
+		}
+		old, ok := before[file.Path]
+		switch {
+		case !ok:
+			changes.Created = append(changes.Created, file)
+		case old.SHA256 != file.SHA256:
+			changes.Modified = append(changes.Modified, file)
+		}
+	}
+	for _, file := range changes.Inputs {
+		if _, ok := after[file.Path]; !ok && !isUnreadable(file.Path) {
+			changes.Deleted = append(changes.Deleted, file)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTrackFileChanges(t *testing.T) {
+	root := t.TempDir()
+	write := func(name string, content string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("input.tif", "raster")
+	write("config/settings.json", "{}")
+	write("old.log", "stale")
+
+	before, unreadable, err := snapshotFiles(root, nil)
+	if err != nil || len(unreadable) != 0 {
+		t.Fatalf("Failed to snapshot: %v, unreadable %v", err, unreadable)
+	}
+
+	write("config/settings.json", "{\"changed\": true}")
+	write("output/result.tif", "result")
+	if err := os.Remove(filepath.Join(root, "old.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	after, unreadable, err := snapshotFiles(root, before)
+	if err != nil || len(unreadable) != 0 {
+		t.Fatalf("Failed to snapshot: %v, unreadable %v", err, unreadable)
+	}
+	changes := compareSnapshots(before, after, nil)
+
+	check := func(kind string, files []trackedFile, expected ...string) {
+		if len(files) != len(expected) {
+			t.Errorf("Expected %d %s files, got %d: %v", len(expected), kind, len(files), files)
+			return
+		}
+		for index, path := range expected {
+			if files[index].Path != path {
+				t.Errorf("Expected %s file %s, got %s", kind, path, files[index].Path)
+			}
+		}
+	}
+	check("input", changes.Inputs, filepath.Join("config", "settings.json"), "input.tif", "old.log")
+	check("created", changes.Created, filepath.Join("output", "result.tif"))
+	check("modified", changes.Modified, filepath.Join("config", "settings.json"))
+	check("deleted", changes.Deleted, "old.log")
+}
+
+func TestTrackUnreadableFiles(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"input.tif", "secret.key", filepath.Join("private", "notes.txt")} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, unreadable, err := snapshotFiles(root, nil)
+	if err != nil || len(unreadable) != 0 {
+		t.Fatalf("Failed to snapshot: %v, unreadable %v", err, unreadable)
+	}
+
+	// permissions don't stop root reading files, so the failures are faked
+	after := fileSnapshot{"input.tif": before["input.tif"]}
+	changes := compareSnapshots(before, after, []string{"secret.key", "private", "secret.key"})
+	if len(changes.Inputs) != 3 {
+		t.Errorf("Expected all files as inputs, got %v", changes.Inputs)
+	}
+	if len(changes.Created) != 0 || len(changes.Modified) != 0 || len(changes.Deleted) != 0 {
+		t.Errorf("Expected unreadable files not to count as changes, got %+v", changes)
+	}
+	expected := []string{"private", "secret.key"}
+	if !reflect.DeepEqual(changes.Unreadable, expected) {
+		t.Errorf("Expected unreadable %v, got %v", expected, changes.Unreadable)
+	}
+
+	if _, _, err := snapshotFiles(filepath.Join(root, "missing"), nil); err == nil {
+		t.Errorf("Expected error for a missing directory")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// When fsark is run interactively we ask runc to allocate a pseudo terminal
+// for the container, which runc hands back to us as the master end over a
+// unix socket (the --console-socket option). We then proxy that to our own
+// terminal, which we put into raw mode so that things like line editing and
+// Ctrl-C are handled by the container's terminal rather than ours.
+
+func isTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+func makeRaw(file *os.File) (func(), error) {
+	fd := int(file.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get terminal state: %w", err)
+	}
+	original := *termios
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, fmt.Errorf("failed to set terminal to raw mode: %w", err)
+	}
+
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, &original)
+	}, nil
+}
+
+func copyWindowSize(from *os.File, to *os.File) error {
+	size, err := unix.IoctlGetWinsize(int(from.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetWinsize(int(to.Fd()), unix.TIOCSWINSZ, size)
+}
+
+func receiveConsole(listener *net.UnixListener) (*os.File, error) {
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept console connection: %w", err)
+	}
+	defer conn.Close()
+
+	name := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	count, oobCount, _, _, err := conn.ReadMsgUnix(name, oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read console message: %w", err)
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobCount])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse console message: %w", err)
+	}
+	if len(messages) != 1 {
+		return nil, fmt.Errorf("expected one control message for console, got %d", len(messages))
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to get console file descriptor: %w", err)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expected one console file descriptor, got %d", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), string(name[:count])), nil
+}
+
+// proxyConsole copies data between our stdin/stdout and the container's
+// console until the container closes its end, keeping the console's window
+// size in step with ours.
+func proxyConsole(console *os.File) error {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	if err := copyWindowSize(os.Stdout, console); err != nil {
+		logWarning("Failed to set console size: %v", err)
+	}
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	// once stopped nothing more is sent on resize, so closing it lets the
+	// goroutine below finish rather than hold on to the console
+	defer func() {
+		signal.Stop(resize)
+		close(resize)
+	}()
+	go func() {
+		for range resize {
+			copyWindowSize(os.Stdout, console)
+		}
+	}()
+
+	// We don't wait for this one, as a read on stdin will block until the
+	// user types something, so we just let it be reaped when main exits.
+	go func() {
+		io.Copy(console, os.Stdin)
+	}()
+
+	_, err = io.Copy(os.Stdout, console)
+	if err != nil {
+		// When the container exits reading the master end of the pty returns
+		// EIO rather than EOF
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+			return nil
+		}
+		return fmt.Errorf("error reading from console: %w", err)
+	}
+	return nil
+}
@@ -4,12 +4,14 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -86,7 +88,10 @@ func loadFileFromContainer(tarballPath string, filepath string, data interface{}
 	}
 }
 
-func unpackRootFS(tarballPath string, rootfsPath string) error {
+// unpackRootFS expands the image into rootfsPath. If ownership is not nil
+// then files are given the owners they have in the image, which only works
+// when run as root in a user namespace with those IDs mapped.
+func unpackRootFS(tarballPath string, rootfsPath string, ownership *ownershipMapping) error {
 	imageManifest, err := loadImageManifest(tarballPath)
 	if err != nil {
 		if err != io.EOF {
@@ -94,11 +99,11 @@ func unpackRootFS(tarballPath string, rootfsPath string) error {
 		}
 		// if the error was io.EOF, we just didn't find the manifest, so
 		// assume we have a container image
-		return unpackContainer(tarballPath, rootfsPath)
+		return unpackContainer(tarballPath, rootfsPath, ownership)
 	}
 
 	// if we got here we have a docker image, so unpack that
-	return unpackImage(tarballPath, rootfsPath, imageManifest.Layers)
+	return unpackImage(tarballPath, rootfsPath, imageManifest.Layers, ownership)
 }
 
 func getContainerConfiguration(tarballPath string) (configurationTopLevel, error) {
@@ -125,7 +130,35 @@ func loadImageManifest(tarballPath string) (imageManifestItem, error) {
 	return manifest[0], nil
 }
 
-func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool) error {
+// restoreOwnership gives a file the owner it has in the tar file.
+func restoreOwnership(targetPath string, header *tar.Header, ownership ownershipMapping) error {
+	uid, gid, ok := ownership.translate(header.Uid, header.Gid)
+	if !ok {
+		// the owner won't exist in the container, so leave it owned by
+		// whoever we are
+		return nil
+	}
+	err := os.Lchown(targetPath, uid, gid)
+	if errors.Is(err, syscall.EINVAL) {
+		// the owner isn't mapped into our namespace, so leave it owned by
+		// root rather than fail
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set owner of %v: %w", targetPath, err)
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// changing owner clears the setuid and setgid bits, so put them back
+	err = os.Chmod(targetPath, header.FileInfo().Mode())
+	if err != nil {
+		return fmt.Errorf("failed to set mode of %v: %w", targetPath, err)
+	}
+	return nil
+}
+
+func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool, ownership *ownershipMapping) error {
 	for {
 		header, err := tarReader.Next()
 		switch {
@@ -152,6 +185,11 @@ func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool) error {
 					return fmt.Errorf("failed to create dir %v: %w", targetPath, err)
 				}
 			}
+			if ownership != nil {
+				if err := restoreOwnership(targetPath, header, *ownership); err != nil {
+					return err
+				}
+			}
 
 		case tar.TypeReg:
 			basename := path.Base(header.Name)
@@ -199,6 +237,11 @@ func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool) error {
 					return fmt.Errorf("failed to copy data for %v: %w", targetPath, err)
 				}
 				f.Close()
+				if ownership != nil {
+					if err := restoreOwnership(targetPath, header, *ownership); err != nil {
+						return err
+					}
+				}
 			}
 
 		case tar.TypeSymlink:
@@ -212,6 +255,11 @@ func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool) error {
 			if err != nil {
 				return fmt.Errorf("failed to create symlink %v %v (overlay=%t): %w", header.Linkname, targetPath, overlay, err)
 			}
+			if ownership != nil {
+				if err := restoreOwnership(targetPath, header, *ownership); err != nil {
+					return err
+				}
+			}
 
 		case tar.TypeLink:
 			if overlay {
@@ -227,12 +275,12 @@ func expandTar(tarReader *tar.Reader, rootfsPath string, overlay bool) error {
 			}
 
 		default:
-			fmt.Printf("Skipping %v of type %v\n", targetPath, header.Typeflag)
+			logDebug("Skipping %v of type %v", targetPath, header.Typeflag)
 		}
 	}
 }
 
-func unpackContainer(imgPath string, rootfsPath string) error {
+func unpackContainer(imgPath string, rootfsPath string, ownership *ownershipMapping) error {
 	file, err := os.Open(imgPath)
 	if err != nil {
 		return fmt.Errorf("failed to open image: %w", err)
@@ -240,10 +288,22 @@ func unpackContainer(imgPath string, rootfsPath string) error {
 	defer file.Close()
 
 	tarReader := tar.NewReader(file)
-	return expandTar(tarReader, rootfsPath, false)
+	return expandTar(tarReader, rootfsPath, false, ownership)
 }
 
-func unpackImage(imgPath string, rootfsPath string, layers []string) error {
+func unpackImage(imgPath string, rootfsPath string, layers []string, ownership *ownershipMapping) error {
+	return forEachLayer(imgPath, layers, func(layer string, layerTarReader *tar.Reader) error {
+		err := expandTar(layerTarReader, rootfsPath, true, ownership)
+		if err != nil {
+			return fmt.Errorf("failed to expand layer %v: %w", layer, err)
+		}
+		return nil
+	})
+}
+
+// forEachLayer calls apply with a reader for each of the layers of an image
+// in turn.
+func forEachLayer(imgPath string, layers []string, apply func(layer string, layerTarReader *tar.Reader) error) error {
 	file, err := os.Open(imgPath)
 	if err != nil {
 		return fmt.Errorf("failed to open image: %w", err)
@@ -292,12 +352,90 @@ func unpackImage(imgPath string, rootfsPath string, layers []string) error {
 			} else {
 				layerTarReader = tar.NewReader(tarReader)
 			}
-			err = expandTar(layerTarReader, rootfsPath, true)
+			err = apply(layer, layerTarReader)
 			if err != nil {
-				return fmt.Errorf("failed to expand layer %v: %w", layer, err)
+				return err
 			}
 			break
 		}
 	}
 	return nil
 }
+
+// readImageFiles returns the contents of the named files as they would be
+// once the image was unpacked, without unpacking it, so that a dry run can
+// look at them. Names are absolute paths, and files the image doesn't have
+// as regular files are left out.
+func readImageFiles(tarballPath string, names []string) (map[string][]byte, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	files := make(map[string][]byte)
+
+	imageManifest, err := loadImageManifest(tarballPath)
+	if err == io.EOF {
+		file, err := os.Open(tarballPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open image: %w", err)
+		}
+		defer file.Close()
+		err = readTarFiles(tar.NewReader(file), false, wanted, files)
+		return files, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = forEachLayer(tarballPath, imageManifest.Layers, func(layer string, layerTarReader *tar.Reader) error {
+		err := readTarFiles(layerTarReader, true, wanted, files)
+		if err != nil {
+			return fmt.Errorf("failed to read layer %v: %w", layer, err)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readTarFiles reads the wanted files from a tar into files, following the
+// same overlay rules as expandTar, so that a later layer replaces or removes
+// what an earlier one had.
+func readTarFiles(tarReader *tar.Reader, overlay bool, wanted map[string]bool, files map[string][]byte) error {
+	for {
+		header, err := tarReader.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return fmt.Errorf("error reading next header: %w", err)
+		case header == nil:
+			continue
+		}
+
+		name := path.Clean("/" + header.Name)
+		directory, basename := path.Split(name)
+		switch {
+		case overlay && basename == ".wh..wh..opq":
+			for existing := range files {
+				if strings.HasPrefix(existing, directory) {
+					delete(files, existing)
+				}
+			}
+		case overlay && strings.HasPrefix(basename, ".wh."):
+			victim := path.Join(directory, strings.TrimPrefix(basename, ".wh."))
+			for existing := range files {
+				if existing == victim || strings.HasPrefix(existing, victim+"/") {
+					delete(files, existing)
+				}
+			}
+		case !wanted[name]:
+		case header.Typeflag == tar.TypeReg:
+			content, err := io.ReadAll(tarReader)
+			if err != nil {
+				return fmt.Errorf("failed to read %v: %w", header.Name, err)
+			}
+			files[name] = content
+		default:
+			delete(files, name)
+		}
+	}
+}
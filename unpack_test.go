@@ -1,6 +1,16 @@
 package main
 
-import "testing"
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
 
 func TestDigestFromConfig(t *testing.T) {
 	testcases := []struct {
@@ -27,3 +37,167 @@ func TestDigestFromConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestImageDigestCached(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	imagePath := filepath.Join(dir, "rootfs.tar")
+	writeArchive := func(content string, modTime time.Time) {
+		var buffer bytes.Buffer
+		writer := tar.NewWriter(&buffer)
+		header := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(content))
+		writer.Close()
+		if err := os.WriteFile(imagePath, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(imagePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	writeArchive("hello", modTime)
+	first, err := imageDigest(imagePath, imagePath, cacheDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the cache can't tell an archive has changed if its size and time
+	// haven't, which shows the archive isn't being read again
+	writeArchive("jelly", modTime)
+	cached, err := imageDigest(imagePath, imagePath, cacheDir)
+	if err != nil || cached != first {
+		t.Errorf("Expected cached digest %v, got %v, %v", first, cached, err)
+	}
+
+	writeArchive("jelly", modTime.Add(time.Second))
+	changed, err := imageDigest(imagePath, imagePath, cacheDir)
+	if err != nil || changed == first {
+		t.Errorf("Expected a new digest for the changed archive, got %v, %v", changed, err)
+	}
+	uncached, err := imageDigest(imagePath, imagePath, "")
+	if err != nil || uncached != changed {
+		t.Errorf("Expected %v without a cache, got %v, %v", changed, uncached, err)
+	}
+}
+
+func TestExpandTarPreservesOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owners needs to be root")
+	}
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	content := []byte("hello")
+	headers := []*tar.Header{
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1001, Gid: 1002},
+		{Name: "home/file", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1001, Gid: 1002, Size: int64(len(content))},
+	}
+	for _, header := range headers {
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := writer.Write(content); err != nil {
+				t.Fatalf("Failed to write tar content: %v", err)
+			}
+		}
+	}
+	writer.Close()
+
+	// unpacking as root outside a user namespace, so every ID is itself
+	identity := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 4294967295}}
+	ownership := ownershipMapping{
+		Container: idMappings{UIDs: identity, GIDs: identity},
+		Namespace: idMappings{UIDs: identity, GIDs: identity},
+	}
+	root := t.TempDir()
+	err := expandTar(tar.NewReader(&buffer), root, false, &ownership)
+	if err != nil {
+		t.Fatalf("Unexpected error expanding tar: %v", err)
+	}
+	for _, name := range []string{"home", "home/file"} {
+		info, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("Failed to stat %v: %v", name, err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1001 || stat.Gid != 1002 {
+			t.Errorf("Expected %v to be owned by 1001:1002, got %d:%d", name, stat.Uid, stat.Gid)
+		}
+	}
+	info, _ := os.Stat(filepath.Join(root, "home/file"))
+	if info.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("Expected setuid bit to be kept, got %v", info.Mode())
+	}
+}
+
+type testTarEntry struct {
+	Name    string
+	Content string
+}
+
+func testTar(t *testing.T, entries ...testTarEntry) []byte {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(entry.Content))}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(entry.Content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestReadImageFiles(t *testing.T) {
+	base := testTar(t,
+		testTarEntry{"etc/passwd", "root:x:0:0:root:/root:/bin/sh\n"},
+		testTarEntry{"etc/group", "root:x:0:\n"},
+		testTarEntry{"etc/hosts", "127.0.0.1 localhost\n"},
+	)
+	top := testTar(t,
+		testTarEntry{"./etc/passwd", testPasswd},
+		testTarEntry{"etc/.wh.group", ""},
+	)
+	image := testTar(t,
+		testTarEntry{"manifest.json", `[{"Config": "config.json", "Layers": ["base/layer.tar", "top/layer.tar"]}]`},
+		testTarEntry{"top/layer.tar", string(top)},
+		testTarEntry{"base/layer.tar", string(base)},
+	)
+	imagePath := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readImageFiles(imagePath, []string{"/etc/passwd", "/etc/group"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(files["/etc/passwd"]) != testPasswd {
+		t.Errorf("Expected passwd from the top layer, got %q", files["/etc/passwd"])
+	}
+	if _, ok := files["/etc/group"]; ok {
+		t.Errorf("Expected group to have been removed by the top layer, got %q", files["/etc/group"])
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only the files asked for, got %v", files)
+	}
+
+	if err := os.WriteFile(imagePath, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err = readImageFiles(imagePath, []string{"/etc/group"})
+	if err != nil || string(files["/etc/group"]) != "root:x:0:\n" {
+		t.Errorf("Expected group from a container archive, got %q, %v", files["/etc/group"], err)
+	}
+}
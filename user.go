@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Commands can set user to choose who the process runs as in the container:
+//
+//   - root: root in the container, which is you on the host. This is the
+//     default.
+//   - host: you, with the same name, IDs and home directory as on the host.
+//     As the image won't know about you, /etc/passwd and /etc/group in the
+//     container are replaced with copies of the image's with you added.
+//   - image: the user set in the image's config, or root if it has none.
+
+const (
+	userModeRoot  = "root"
+	userModeHost  = "host"
+	userModeImage = "image"
+
+	passwdOverlayFilename = "passwd"
+	groupOverlayFilename  = "group"
+)
+
+type containerGroup struct {
+	Name string
+	GID  uint32
+}
+
+type containerUser struct {
+	Name   string
+	UID    uint32
+	GID    uint32
+	Home   string
+	Groups []containerGroup
+}
+
+func validateUserMode(mode string) error {
+	switch mode {
+	case "", userModeRoot, userModeHost, userModeImage:
+		return nil
+	default:
+		return fmt.Errorf("unknown user %q, expected %s, %s or %s", mode, userModeRoot, userModeHost, userModeImage)
+	}
+}
+
+// hostContainerUser describes the invoking user.
+func hostContainerUser() (containerUser, error) {
+	current, err := user.Current()
+	if err != nil {
+		return containerUser{}, fmt.Errorf("failed to look up current user: %w", err)
+	}
+	uid, err := strconv.ParseUint(current.Uid, 10, 32)
+	if err != nil {
+		return containerUser{}, fmt.Errorf("bad uid %q: %w", current.Uid, err)
+	}
+	gid, err := strconv.ParseUint(current.Gid, 10, 32)
+	if err != nil {
+		return containerUser{}, fmt.Errorf("bad gid %q: %w", current.Gid, err)
+	}
+	result := containerUser{
+		Name: current.Username,
+		UID:  uint32(uid),
+		GID:  uint32(gid),
+		Home: current.HomeDir,
+	}
+
+	groupIDs, err := current.GroupIds()
+	if err != nil {
+		return containerUser{}, fmt.Errorf("failed to look up groups: %w", err)
+	}
+	for _, groupID := range groupIDs {
+		group, err := user.LookupGroupId(groupID)
+		if err != nil {
+			// groups without names are no use in /etc/group
+			continue
+		}
+		id, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			continue
+		}
+		result.Groups = append(result.Groups, containerGroup{Name: group.Name, GID: uint32(id)})
+	}
+	return result, nil
+}
+
+type passwdEntry struct {
+	Name string
+	UID  uint32
+	GID  uint32
+	Home string
+}
+
+func parsePasswd(content []byte) []passwdEntry {
+	var entries []passwdEntry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) < 7 {
+			continue
+		}
+		uid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.ParseUint(parts[3], 10, 32)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, passwdEntry{Name: parts[0], UID: uint32(uid), GID: uint32(gid), Home: parts[5]})
+	}
+	return entries
+}
+
+func parseGroups(content []byte) []containerGroup {
+	var groups []containerGroup
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) < 3 {
+			continue
+		}
+		gid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, containerGroup{Name: parts[0], GID: uint32(gid)})
+	}
+	return groups
+}
+
+// imageContainerUser looks up the user from an image's config, which can be
+// a name or ID, optionally followed by a colon and a group name or ID, in
+// the image's /etc/passwd and /etc/group.
+func imageContainerUser(rootfs string, setting string) (containerUser, error) {
+	passwd, err := os.ReadFile(filepath.Join(rootfs, "etc", "passwd"))
+	if err != nil && !os.IsNotExist(err) {
+		return containerUser{}, fmt.Errorf("failed to read image's /etc/passwd: %w", err)
+	}
+	groups, err := os.ReadFile(filepath.Join(rootfs, "etc", "group"))
+	if err != nil && !os.IsNotExist(err) {
+		return containerUser{}, fmt.Errorf("failed to read image's /etc/group: %w", err)
+	}
+	return lookUpImageUser(passwd, groups, setting)
+}
+
+// unpackedImageUser is imageContainerUser for an image that hasn't been
+// unpacked, which reads /etc/passwd and /etc/group straight from it.
+func unpackedImageUser(imagePath string, setting string) (containerUser, error) {
+	files, err := readImageFiles(imagePath, []string{"/etc/passwd", "/etc/group"})
+	if err != nil {
+		return containerUser{}, fmt.Errorf("failed to read users from image: %w", err)
+	}
+	return lookUpImageUser(files["/etc/passwd"], files["/etc/group"], setting)
+}
+
+func lookUpImageUser(passwd []byte, groups []byte, setting string) (containerUser, error) {
+	if setting == "" {
+		setting = "0"
+	}
+	userPart, groupPart, hasGroup := strings.Cut(setting, ":")
+
+	var result containerUser
+	found := false
+	for _, entry := range parsePasswd(passwd) {
+		if entry.Name == userPart || strconv.FormatUint(uint64(entry.UID), 10) == userPart {
+			result = containerUser{Name: entry.Name, UID: entry.UID, GID: entry.GID, Home: entry.Home}
+			found = true
+			break
+		}
+	}
+	if !found {
+		uid, err := strconv.ParseUint(userPart, 10, 32)
+		if err != nil {
+			return containerUser{}, fmt.Errorf("image user %q is not in the image's /etc/passwd", userPart)
+		}
+		result = containerUser{UID: uint32(uid), GID: uint32(uid), Home: "/"}
+	}
+
+	if hasGroup {
+		found = false
+		for _, group := range parseGroups(groups) {
+			if group.Name == groupPart || strconv.FormatUint(uint64(group.GID), 10) == groupPart {
+				result.GID = group.GID
+				found = true
+				break
+			}
+		}
+		if !found {
+			gid, err := strconv.ParseUint(groupPart, 10, 32)
+			if err != nil {
+				return containerUser{}, fmt.Errorf("image group %q is not in the image's /etc/group", groupPart)
+			}
+			result.GID = uint32(gid)
+		}
+	}
+	return result, nil
+}
+
+// replaceEntries removes lines from a passwd or group file whose name or ID
+// match, and adds the new lines at the end.
+func replaceEntries(content []byte, names map[string]bool, ids map[string]bool, lines []string) []byte {
+	var result bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) >= 3 && (names[parts[0]] || ids[parts[2]]) {
+			continue
+		}
+		result.WriteString(scanner.Text())
+		result.WriteString("\n")
+	}
+	for _, line := range lines {
+		result.WriteString(line)
+		result.WriteString("\n")
+	}
+	return result.Bytes()
+}
+
+// passwdOverlay returns the image's /etc/passwd with the user added.
+func (u containerUser) passwdOverlay(imagePasswd []byte) []byte {
+	uid := strconv.FormatUint(uint64(u.UID), 10)
+	line := fmt.Sprintf("%s:x:%d:%d:%s:%s:/bin/sh", u.Name, u.UID, u.GID, u.Name, u.Home)
+	return replaceEntries(imagePasswd, map[string]bool{u.Name: true}, map[string]bool{uid: true}, []string{line})
+}
+
+// groupOverlay returns the image's /etc/group with the user's groups added.
+func (u containerUser) groupOverlay(imageGroup []byte) []byte {
+	names := make(map[string]bool)
+	ids := make(map[string]bool)
+	var lines []string
+	primaryListed := false
+	for _, group := range u.Groups {
+		gid := strconv.FormatUint(uint64(group.GID), 10)
+		if names[group.Name] || ids[gid] {
+			continue
+		}
+		names[group.Name] = true
+		ids[gid] = true
+		if group.GID == u.GID {
+			primaryListed = true
+			lines = append(lines, fmt.Sprintf("%s:x:%d:", group.Name, group.GID))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:x:%d:%s", group.Name, group.GID, u.Name))
+		}
+	}
+	if !primaryListed {
+		lines = append(lines, fmt.Sprintf("%s:x:%d:", u.Name, u.GID))
+		names[u.Name] = true
+		ids[strconv.FormatUint(uint64(u.GID), 10)] = true
+	}
+	return replaceEntries(imageGroup, names, ids, lines)
+}
+
+// writeOverlays writes the passwd and group files to mount over the image's
+// into the bundle.
+func (u containerUser) writeOverlays(bundlePath string, rootfs string) error {
+	passwd, err := os.ReadFile(filepath.Join(rootfs, "etc", "passwd"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read image's /etc/passwd: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(bundlePath, passwdOverlayFilename), u.passwdOverlay(passwd), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write /etc/passwd for container: %w", err)
+	}
+	group, err := os.ReadFile(filepath.Join(rootfs, "etc", "group"))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read image's /etc/group: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(bundlePath, groupOverlayFilename), u.groupOverlay(group), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write /etc/group for container: %w", err)
+	}
+	return nil
+}
+
+// overlayMounts are the mounts for the files made by writeOverlays.
+func overlayMounts(bundlePath string) []BindMount {
+	return []BindMount{
+		{
+			Source:      filepath.Join(bundlePath, passwdOverlayFilename),
+			Destination: "/etc/passwd",
+			ReadOnly:    true,
+		},
+		{
+			Source:      filepath.Join(bundlePath, groupOverlayFilename),
+			Destination: "/etc/group",
+			ReadOnly:    true,
+		},
+	}
+}
+
+// applyContainerUser makes the spec run the process as the user, and sets
+// HOME to their home directory unless the command's config has set it.
+func applyContainerUser(spec *specs.Spec, u containerUser) {
+	spec.Process.User = specs.User{
+		UID: u.UID,
+		GID: u.GID,
+	}
+	for _, item := range spec.Process.Env {
+		if strings.HasPrefix(item, "HOME=") {
+			return
+		}
+	}
+	if u.Home != "" {
+		spec.Process.Env = append(spec.Process.Env, fmt.Sprintf("HOME=%s", u.Home))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+postgres:x:999:999::/var/lib/postgresql:/bin/sh
+ubuntu:x:1000:1000:Ubuntu:/home/ubuntu:/bin/bash
+`
+
+const testGroup = `root:x:0:
+postgres:x:999:
+ubuntu:x:1000:
+docker:x:998:ubuntu
+`
+
+func TestOverlays(t *testing.T) {
+	alice := containerUser{
+		Name: "alice",
+		UID:  1000,
+		GID:  1000,
+		Home: "/home/alice",
+		Groups: []containerGroup{
+			{Name: "alice", GID: 1000},
+			{Name: "docker", GID: 130},
+		},
+	}
+
+	passwd := string(alice.passwdOverlay([]byte(testPasswd)))
+	expected := `root:x:0:0:root:/root:/bin/bash
+postgres:x:999:999::/var/lib/postgresql:/bin/sh
+alice:x:1000:1000:alice:/home/alice:/bin/sh
+`
+	if passwd != expected {
+		t.Errorf("Expected passwd:\n%s\ngot:\n%s", expected, passwd)
+	}
+
+	group := string(alice.groupOverlay([]byte(testGroup)))
+	expected = `root:x:0:
+postgres:x:999:
+alice:x:1000:
+docker:x:130:alice
+`
+	if group != expected {
+		t.Errorf("Expected group:\n%s\ngot:\n%s", expected, group)
+	}
+
+	// with no groups and no files in the image we still get the primary group
+	bob := containerUser{Name: "bob", UID: 1001, GID: 1001, Home: "/home/bob"}
+	group = string(bob.groupOverlay(nil))
+	if group != "bob:x:1001:\n" {
+		t.Errorf("Expected just bob's group, got:\n%s", group)
+	}
+}
+
+func TestImageContainerUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(testPasswd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(testGroup), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		Setting  string
+		Expected containerUser
+	}{
+		{"", containerUser{Name: "root", UID: 0, GID: 0, Home: "/root"}},
+		{"postgres", containerUser{Name: "postgres", UID: 999, GID: 999, Home: "/var/lib/postgresql"}},
+		{"1000", containerUser{Name: "ubuntu", UID: 1000, GID: 1000, Home: "/home/ubuntu"}},
+		{"ubuntu:docker", containerUser{Name: "ubuntu", UID: 1000, GID: 998, Home: "/home/ubuntu"}},
+		{"2000:3000", containerUser{UID: 2000, GID: 3000, Home: "/"}},
+	}
+	for _, testcase := range testcases {
+		user, err := imageContainerUser(rootfs, testcase.Setting)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Setting, err)
+			continue
+		}
+		if user.Name != testcase.Expected.Name || user.UID != testcase.Expected.UID || user.GID != testcase.Expected.GID || user.Home != testcase.Expected.Home {
+			t.Errorf("Expected %v for %q, got %v", testcase.Expected, testcase.Setting, user)
+		}
+	}
+
+	for _, setting := range []string{"nobody", "ubuntu:wheel"} {
+		if _, err := imageContainerUser(rootfs, setting); err == nil {
+			t.Errorf("Expected error for %q", setting)
+		}
+	}
+}
+
+func TestUnpackedImageUser(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "rootfs.tar")
+	image := testTar(t, testTarEntry{"etc/passwd", testPasswd}, testTarEntry{"etc/group", testGroup})
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	user, err := unpackedImageUser(imagePath, "ubuntu:docker")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user.Name != "ubuntu" || user.UID != 1000 || user.GID != 998 || user.Home != "/home/ubuntu" {
+		t.Errorf("Expected ubuntu in the docker group, got %v", user)
+	}
+}
+
+func TestApplyContainerUser(t *testing.T) {
+	spec := specs.Spec{Process: &specs.Process{Env: []string{"PATH=/bin"}}}
+	applyContainerUser(&spec, containerUser{UID: 1000, GID: 100, Home: "/home/alice"})
+	if spec.Process.User.UID != 1000 || spec.Process.User.GID != 100 {
+		t.Errorf("Expected user 1000:100, got %v", spec.Process.User)
+	}
+	if spec.Process.Env[len(spec.Process.Env)-1] != "HOME=/home/alice" {
+		t.Errorf("Expected HOME to be set, got %v", spec.Process.Env)
+	}
+
+	spec = specs.Spec{Process: &specs.Process{Env: []string{"HOME=/data"}}}
+	applyContainerUser(&spec, containerUser{UID: 1000, GID: 100, Home: "/home/alice"})
+	if len(spec.Process.Env) != 1 {
+		t.Errorf("Expected HOME from config to be kept, got %v", spec.Process.Env)
+	}
+
+	if err := validateUserMode("nobody"); err == nil {
+		t.Errorf("Expected error for unknown user mode")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Volumes are directories kept in the fsark state directory that commands
+// can mount, so that caches and downloads persist between runs. They are
+// declared at the top level of the config, and each command that mounts a
+// volume gets its own copy unless the volume is shared, in which case all
+// the commands that mount it see the same directory.
+//
+// Commands list the volumes they mount as name:path, or name:path:ro to
+// mount them read only.
+
+type VolumeConfig struct {
+	Shared bool `json:"shared"`
+}
+
+type volumeMount struct {
+	Name        string
+	Destination string
+	ReadOnly    bool
+}
+
+const (
+	volumesDirectoryName = "volumes"
+	sharedVolumesName    = "shared"
+	commandVolumesName   = "commands"
+)
+
+func validateVolumeName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/:") {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	return nil
+}
+
+func parseVolumeMount(value string) (volumeMount, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return volumeMount{}, fmt.Errorf("bad volume %q, expected name:path or name:path:ro", value)
+	}
+	mount := volumeMount{
+		Name:        parts[0],
+		Destination: parts[1],
+	}
+	if err := validateVolumeName(mount.Name); err != nil {
+		return volumeMount{}, err
+	}
+	if !path.IsAbs(mount.Destination) {
+		return volumeMount{}, fmt.Errorf("bad volume %q, %q is not an absolute path", value, mount.Destination)
+	}
+	if len(parts) == 3 {
+		if parts[2] != "ro" {
+			return volumeMount{}, fmt.Errorf("bad volume %q, unknown option %q", value, parts[2])
+		}
+		mount.ReadOnly = true
+	}
+	return mount, nil
+}
+
+func validateVolumes(conf Config, volumes []string) error {
+	for _, value := range volumes {
+		mount, err := parseVolumeMount(value)
+		if err != nil {
+			return err
+		}
+		if _, ok := conf.Volumes[mount.Name]; !ok {
+			return fmt.Errorf("volume %v is not declared in the config", mount.Name)
+		}
+	}
+	return nil
+}
+
+// volumeDirectory is where the volume is kept for the given command.
+func volumeDirectory(stateDir string, conf Config, name string, commandName string) string {
+	if conf.Volumes[name].Shared {
+		return filepath.Join(stateDir, volumesDirectoryName, sharedVolumesName, name)
+	}
+	return filepath.Join(stateDir, volumesDirectoryName, commandVolumesName, commandName, name)
+}
+
+// resolveVolumeMounts returns the mounts for the command's volumes, creating
+// the volumes if they don't yet exist.
+func resolveVolumeMounts(conf Config, commandName string, commandConfig Wrapper, variables expansionVariables) ([]BindMount, error) {
+	if len(commandConfig.Volumes) == 0 {
+		return nil, nil
+	}
+	stateDir, err := stateDirectory(conf, variables)
+	if err != nil {
+		return nil, err
+	}
+	mounts := make([]BindMount, 0, len(commandConfig.Volumes))
+	for _, value := range commandConfig.Volumes {
+		volume, err := parseVolumeMount(value)
+		if err != nil {
+			return nil, err
+		}
+		dir := volumeDirectory(stateDir, conf, volume.Name, commandName)
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create volume %v: %w", volume.Name, err)
+		}
+		mounts = append(mounts, BindMount{
+			Source:      dir,
+			Destination: volume.Destination,
+			ReadOnly:    volume.ReadOnly,
+		})
+	}
+	return mounts, nil
+}
+
+type volumeInfo struct {
+	Name    string
+	Command string
+	Path    string
+}
+
+// listVolumes finds all the volumes in the state directory, whether or not
+// they're still in the config.
+func listVolumes(stateDir string) ([]volumeInfo, error) {
+	var volumes []volumeInfo
+	sharedDir := filepath.Join(stateDir, volumesDirectoryName, sharedVolumesName)
+	entries, err := os.ReadDir(sharedDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read volumes: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			volumes = append(volumes, volumeInfo{Name: entry.Name(), Path: filepath.Join(sharedDir, entry.Name())})
+		}
+	}
+
+	commandsDir := filepath.Join(stateDir, volumesDirectoryName, commandVolumesName)
+	commands, err := os.ReadDir(commandsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read volumes: %w", err)
+	}
+	for _, command := range commands {
+		if !command.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(commandsDir, command.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read volumes: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				volumes = append(volumes, volumeInfo{
+					Name:    entry.Name(),
+					Command: command.Name(),
+					Path:    filepath.Join(commandsDir, command.Name(), entry.Name()),
+				})
+			}
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		if volumes[i].Name != volumes[j].Name {
+			return volumes[i].Name < volumes[j].Name
+		}
+		return volumes[i].Command < volumes[j].Command
+	})
+	return volumes, nil
+}
+
+// inUse is true if the volume is still declared in the config and mounted
+// by the command it belongs to, or any command if it's shared.
+func (v volumeInfo) inUse(conf Config) bool {
+	volume, ok := conf.Volumes[v.Name]
+	if !ok || volume.Shared != (v.Command == "") {
+		return false
+	}
+	for name, command := range conf.Commands {
+		if v.Command != "" && name != v.Command {
+			continue
+		}
+		for _, value := range command.Volumes {
+			if mount, err := parseVolumeMount(value); err == nil && mount.Name == v.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// with subordinate IDs some of the volume may not be readable
+			// by us, so just count what we can
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// removeVolume deletes a volume, which may contain files owned by
+// subordinate IDs, and so needs removing from within a user namespace.
+func removeVolume(volume volumeInfo) error {
+	mappings, err := resolveIDMappings()
+	if err != nil {
+		return err
+	}
+	return removeMapped(volume.Path, mappings)
+}
+
+func runVolume(ctx subcommandContext, args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "usage: %s volume ls\n       %s volume rm [-command name] <volume>...\n       %s volume prune\n", fsarkName, fsarkName, fsarkName)
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	stateDir, err := stateDirectory(ctx.conf, ctx.variables)
+	if err != nil {
+		logError("Failed to find state directory: %v", err)
+		return 1
+	}
+	volumes, err := listVolumes(stateDir)
+	if err != nil {
+		logError("%v", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "ls":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(writer, "NAME\tCOMMAND\tSIZE\tIN USE\tPATH\n")
+		for _, volume := range volumes {
+			command := volume.Command
+			if command == "" {
+				command = "(shared)"
+			}
+			inUse := "no"
+			if volume.inUse(ctx.conf) {
+				inUse = "yes"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", volume.Name, command, formatSize(directorySize(volume.Path)), inUse, volume.Path)
+		}
+		writer.Flush()
+		return 0
+
+	case "rm":
+		flags := flag.NewFlagSet("volume rm", flag.ContinueOnError)
+		commandName := flags.String("command", "", "only remove the volume belonging to this command")
+		flags.Usage = func() {
+			usage()
+			flags.PrintDefaults()
+		}
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			flags.Usage()
+			return 2
+		}
+		retcode := 0
+		for _, name := range flags.Args() {
+			found := false
+			for _, volume := range volumes {
+				if volume.Name != name || (*commandName != "" && volume.Command != *commandName) {
+					continue
+				}
+				found = true
+				if err := removeVolume(volume); err != nil {
+					logError("Failed to remove volume %v: %v", volume.Path, err)
+					retcode = 1
+				}
+			}
+			if !found {
+				logError("No volume named %v", name)
+				retcode = 1
+			}
+		}
+		return retcode
+
+	case "prune":
+		retcode := 0
+		for _, volume := range volumes {
+			if volume.inUse(ctx.conf) {
+				continue
+			}
+			if err := removeVolume(volume); err != nil {
+				logError("Failed to remove volume %v: %v", volume.Path, err)
+				retcode = 1
+				continue
+			}
+			fmt.Println(volume.Path)
+		}
+		return retcode
+
+	default:
+		usage()
+		return 2
+	}
+}
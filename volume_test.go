@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseVolumeMount(t *testing.T) {
+	testcases := []struct {
+		Value    string
+		Expected volumeMount
+	}{
+		{"pip:/root/.cache/pip", volumeMount{Name: "pip", Destination: "/root/.cache/pip"}},
+		{"models:/models:ro", volumeMount{Name: "models", Destination: "/models", ReadOnly: true}},
+	}
+	for _, testcase := range testcases {
+		mount, err := parseVolumeMount(testcase.Value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", testcase.Value, err)
+			continue
+		}
+		if mount != testcase.Expected {
+			t.Errorf("Expected %v for %q, got %v", testcase.Expected, testcase.Value, mount)
+		}
+	}
+
+	for _, value := range []string{"pip", "pip:cache", "pip:/cache:rw", "../pip:/cache", ":/cache", "a:/b:ro:x"} {
+		if _, err := parseVolumeMount(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	stateDir := t.TempDir()
+	conf := Config{
+		StateDirectory: stateDir,
+		Volumes: map[string]VolumeConfig{
+			"pip":    {},
+			"models": {Shared: true},
+		},
+		Commands: map[string]Wrapper{
+			"train": {Volumes: []string{"pip:/root/.cache/pip", "models:/models"}},
+			"infer": {Volumes: []string{"models:/models:ro"}},
+		},
+	}
+	if err := validateVolumes(conf, []string{"conda:/opt/conda/pkgs"}); err == nil {
+		t.Errorf("Expected error for undeclared volume")
+	}
+
+	variables := expansionVariables{fsark: map[string]string{}}
+	mounts, err := resolveVolumeMounts(conf, "train", conf.Commands["train"], variables)
+	if err != nil {
+		t.Fatalf("Unexpected error resolving volumes: %v", err)
+	}
+	expected := []BindMount{
+		{Source: filepath.Join(stateDir, "volumes", "commands", "train", "pip"), Destination: "/root/.cache/pip"},
+		{Source: filepath.Join(stateDir, "volumes", "shared", "models"), Destination: "/models"},
+	}
+	if len(mounts) != len(expected) || mounts[0] != expected[0] || mounts[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, mounts)
+	}
+
+	// a volume left behind by a command no longer using it
+	conf.Commands["old"] = Wrapper{Volumes: []string{"pip:/cache"}}
+	if _, err := resolveVolumeMounts(conf, "old", conf.Commands["old"], variables); err != nil {
+		t.Fatalf("Unexpected error resolving volumes: %v", err)
+	}
+	delete(conf.Commands, "old")
+
+	volumes, err := listVolumes(stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error listing volumes: %v", err)
+	}
+	if len(volumes) != 3 {
+		t.Fatalf("Expected three volumes, got %v", volumes)
+	}
+	inUse := map[string]bool{}
+	for _, volume := range volumes {
+		inUse[volume.Name+"@"+volume.Command] = volume.inUse(conf)
+	}
+	expectedInUse := map[string]bool{"models@": true, "pip@old": false, "pip@train": true}
+	for key, value := range expectedInUse {
+		if inUse[key] != value {
+			t.Errorf("Expected %v in use to be %t, got %v", key, value, inUse)
+		}
+	}
+}